@@ -3,34 +3,322 @@ package log_v1
 import (
 	"fmt"
 
+	"github.com/golang/protobuf/proto"
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+// The errors in this file are the ones the log returns to clients. Each one knows its
+// gRPC status (so gRPC sends the right code, along with a message the client can show
+// to its users), and its Error is the status's error, so it reads the same everywhere.
+
+// withDetails adds details to the status, or returns the status as-is if it can't.
+func withDetails(st *status.Status, details ...proto.Message) *status.Status {
+	std, err := st.WithDetails(details...)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+// localized returns a LocalizedMessage detail with the given message.
+func localized(format string, a ...interface{}) *errdetails.LocalizedMessage {
+	return &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+// ErrOffsetOutOfRange is returned when a client reads an offset the log doesn't have,
+// either because the log hasn't got there yet or because it removed the offset.
 type ErrOffsetOutOfRange struct {
 	Offset uint64
 }
 
 func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 	st := status.New(
-		404,
+		codes.OutOfRange,
 		fmt.Sprintf("offset out of range: %d", e.Offset),
 	)
-	msg := fmt.Sprintf(
+	return withDetails(st, localized(
 		"The requested offset is outside the log's range: %d",
 		e.Offset,
+	))
+}
+
+func (e ErrOffsetOutOfRange) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrLogClosed is returned when the log closed under the request, which happens when
+// the server shuts down. The client can retry once the server is back.
+type ErrLogClosed struct{}
+
+func (e ErrLogClosed) GRPCStatus() *status.Status {
+	st := status.New(codes.Unavailable, "log closed")
+	return withDetails(st, localized("The log is closed, try again later"))
+}
+
+func (e ErrLogClosed) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrRecordTooLarge is returned when a client produces a record bigger than the log
+// accepts. Size and Max are the record's size and the limit, in bytes.
+type ErrRecordTooLarge struct {
+	Size uint64
+	Max  uint64
+}
+
+func (e ErrRecordTooLarge) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("record too large: %d bytes", e.Size),
 	)
-	d := &errdetails.LocalizedMessage{
-		Locale: "en-US",
-		Message: msg,
-	}
-	std, err := st.WithDetails(d)
-	if err != nil {
-		return st
+	return withDetails(
+		st,
+		&errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+				Field:       "record",
+				Description: fmt.Sprintf("record is %d bytes, the max is %d", e.Size, e.Max),
+			}},
+		},
+		localized(
+			"The record is %d bytes, which is more than the log's limit of %d bytes",
+			e.Size,
+			e.Max,
+		),
+	)
+}
+
+func (e ErrRecordTooLarge) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrCorruptRecord is returned when the record stored at Offset fails its checksum.
+// BaseOffset and Position tell the operator which segment is damaged and where in its store.
+type ErrCorruptRecord struct {
+	Offset     uint64
+	BaseOffset uint64
+	Position   uint64
+}
+
+func (e ErrCorruptRecord) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.DataLoss,
+		fmt.Sprintf("corrupt record: %d", e.Offset),
+	)
+	return withDetails(st, localized(
+		"The record at offset %d is corrupt (segment %d, position %d)",
+		e.Offset,
+		e.BaseOffset,
+		e.Position,
+	))
+}
+
+func (e ErrCorruptRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrReadOnly is returned when a client produces to a log that only serves reads.
+type ErrReadOnly struct{}
+
+func (e ErrReadOnly) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, "log is read-only")
+	return withDetails(
+		st,
+		&errdetails.PreconditionFailure{
+			Violations: []*errdetails.PreconditionFailure_Violation{{
+				Type:        "READ_ONLY",
+				Subject:     "log",
+				Description: "the log doesn't accept writes",
+			}},
+		},
+		localized("The log is read-only and doesn't accept new records"),
+	)
+}
+
+func (e ErrReadOnly) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrTopicNotFound is returned when a client uses a topic the server doesn't have, and
+// doesn't create on demand.
+type ErrTopicNotFound struct {
+	Topic string
+}
+
+func (e ErrTopicNotFound) GRPCStatus() *status.Status {
+	st := status.New(codes.NotFound, fmt.Sprintf("topic not found: %s", e.Topic))
+	return withDetails(st, localized("The topic %q doesn't exist", e.Topic))
+}
+
+func (e ErrTopicNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrTopicExists is returned when a client creates a topic that already exists.
+type ErrTopicExists struct {
+	Topic string
+}
+
+func (e ErrTopicExists) GRPCStatus() *status.Status {
+	st := status.New(codes.AlreadyExists, fmt.Sprintf("topic exists: %s", e.Topic))
+	return withDetails(st, localized("The topic %q already exists", e.Topic))
+}
+
+func (e ErrTopicExists) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrInvalidTopic is returned when a client names a topic with a name the server can't
+// store it under. Topic names are up to 249 letters, digits, dots, underscores and dashes.
+type ErrInvalidTopic struct {
+	Topic string
+}
+
+func (e ErrInvalidTopic) GRPCStatus() *status.Status {
+	st := status.New(codes.InvalidArgument, fmt.Sprintf("invalid topic: %q", e.Topic))
+	return withDetails(
+		st,
+		&errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+				Field:       "topic",
+				Description: "topic names are up to 249 letters, digits, dots, underscores and dashes",
+			}},
+		},
+		localized("%q isn't a valid topic name", e.Topic),
+	)
+}
+
+func (e ErrInvalidTopic) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrPartitionNotFound is returned when a client uses a partition the topic doesn't have.
+type ErrPartitionNotFound struct {
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrPartitionNotFound) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("partition not found: %s/%d", e.Topic, e.Partition),
+	)
+	return withDetails(st, localized(
+		"The topic %q doesn't have a partition %d",
+		e.Topic,
+		e.Partition,
+	))
+}
+
+func (e ErrPartitionNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrOffsetNotCommitted is returned when a client fetches the offset of a consumer group
+// that hasn't committed one for the partition.
+type ErrOffsetNotCommitted struct {
+	Group     string
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrOffsetNotCommitted) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("offset not committed: %s on %s/%d", e.Group, e.Topic, e.Partition),
+	)
+	return withDetails(st, localized(
+		"The group %q hasn't committed an offset for partition %d of the topic %q",
+		e.Group,
+		e.Partition,
+		e.Topic,
+	))
+}
+
+func (e ErrOffsetNotCommitted) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrUnknownMember is returned when a consumer sends a heartbeat for, or reads the
+// assignments of, a membership the group doesn't have anymore: the member left, or its
+// session timed out. The consumer has to join the group again.
+type ErrUnknownMember struct {
+	Group    string
+	MemberID string
+}
+
+func (e ErrUnknownMember) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("unknown member: %s in group %s", e.MemberID, e.Group),
+	)
+	return withDetails(st, localized(
+		"The group %q doesn't have the member %q, join the group again",
+		e.Group,
+		e.MemberID,
+	))
+}
+
+func (e ErrUnknownMember) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrInconsistentStrategy is returned when a consumer joins a group with another assignment
+// strategy than the group's members use.
+type ErrInconsistentStrategy struct {
+	Group    string
+	Strategy string
+}
+
+func (e ErrInconsistentStrategy) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("group %s uses the %s strategy", e.Group, e.Strategy),
+	)
+	return withDetails(st, localized(
+		"The members of the group %q assign partitions with the %s strategy, join with the same one",
+		e.Group,
+		e.Strategy,
+	))
+}
+
+func (e ErrInconsistentStrategy) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrCoordinatorClosed is returned when the group coordinator closed under the request,
+// which happens when the server shuts down. The consumer can join again once the server is back.
+type ErrCoordinatorClosed struct{}
+
+func (e ErrCoordinatorClosed) GRPCStatus() *status.Status {
+	st := status.New(codes.Unavailable, "coordinator closed")
+	return withDetails(st, localized("The group coordinator is closed, try again later"))
+}
+
+func (e ErrCoordinatorClosed) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrNotLeader is returned when a client produces to a server of a distributed log that isn't
+// the cluster's leader. Leader is the leader's address, empty while the cluster elects one, so
+// the client can produce to the leader instead.
+type ErrNotLeader struct {
+	Leader string
+}
+
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	if e.Leader == "" {
+		st := status.New(codes.Unavailable, "no leader")
+		return withDetails(st, localized("The cluster is electing a leader, try again later"))
 	}
-	return std
+	st := status.New(codes.Unavailable, fmt.Sprintf("not the leader, the leader is %s", e.Leader))
+	return withDetails(st, localized("This server isn't the leader, produce to %s instead", e.Leader))
 }
 
-func (e ErrOffsetOutOfRange) Error() string {
+func (e ErrNotLeader) Error() string {
 	return e.GRPCStatus().Err().Error()
-}
\ No newline at end of file
+}
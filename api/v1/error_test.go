@@ -0,0 +1,67 @@
+package log_v1
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestErrors(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code codes.Code
+		msg  string
+	}{
+		{ErrOffsetOutOfRange{Offset: 5}, codes.OutOfRange, "offset out of range: 5"},
+		{ErrLogClosed{}, codes.Unavailable, "log closed"},
+		{ErrRecordTooLarge{Size: 10, Max: 5}, codes.InvalidArgument, "record too large: 10 bytes"},
+		{ErrCorruptRecord{Offset: 5}, codes.DataLoss, "corrupt record: 5"},
+		{ErrReadOnly{}, codes.FailedPrecondition, "log is read-only"},
+		{ErrTopicNotFound{Topic: "orders"}, codes.NotFound, "topic not found: orders"},
+		{ErrTopicExists{Topic: "orders"}, codes.AlreadyExists, "topic exists: orders"},
+		{ErrInvalidTopic{Topic: "a/b"}, codes.InvalidArgument, `invalid topic: "a/b"`},
+		{ErrPartitionNotFound{Topic: "orders", Partition: 3}, codes.NotFound, "partition not found: orders/3"},
+		{
+			ErrOffsetNotCommitted{Group: "billing", Topic: "orders", Partition: 3},
+			codes.NotFound,
+			"offset not committed: billing on orders/3",
+		},
+		{
+			ErrUnknownMember{Group: "billing", MemberID: "a1"},
+			codes.NotFound,
+			"unknown member: a1 in group billing",
+		},
+		{
+			ErrInconsistentStrategy{Group: "billing", Strategy: "range"},
+			codes.FailedPrecondition,
+			"group billing uses the range strategy",
+		},
+		{ErrCoordinatorClosed{}, codes.Unavailable, "coordinator closed"},
+		{ErrNotLeader{}, codes.Unavailable, "no leader"},
+		{
+			ErrNotLeader{Leader: "127.0.0.1:8401"},
+			codes.Unavailable,
+			"not the leader, the leader is 127.0.0.1:8401",
+		},
+	} {
+		t.Run(tc.msg, func(t *testing.T) {
+			st, ok := status.FromError(tc.err)
+			require.True(t, ok)
+			require.Equal(t, tc.code, st.Code())
+			require.Equal(t, tc.msg, st.Message())
+			require.Equal(t, st.Err().Error(), tc.err.Error())
+
+			// every error tells the client what went wrong in a message it can show.
+			var localized bool
+			for _, d := range st.Details() {
+				if _, ok := d.(*errdetails.LocalizedMessage); ok {
+					localized = true
+				}
+			}
+			require.True(t, localized)
+		})
+	}
+}
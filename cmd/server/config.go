@@ -0,0 +1,255 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	plog "github.com/hafizmfadli/proglog/internal/log"
+	"gopkg.in/yaml.v3"
+)
+
+// config holds everything the server needs to run. We take it from a YAML file
+// (given with -config) and from flags, and a flag you set wins over the file:
+//
+//	data_dir: /var/lib/proglog
+//	grpc_addr: ":8400"
+//	http_addr: ":8080"
+//	log_level: info
+//	shutdown_timeout: 10s
+//	segment:
+//	  max_store_bytes: 1048576
+//	  max_index_bytes: 1048576
+//	  max_record_bytes: 1048576
+//	durability:
+//	  policy: interval
+//	  interval: 10ms
+//	retention:
+//	  max_bytes: 1073741824
+//	  max_age: 168h
+//	  min_offsets: 1000
+//	  interval: 1m
+//	compaction:
+//	  enabled: true
+//	  delete_retention: 24h
+//	  interval: 1m
+//	tls:
+//	  cert_file: server.pem
+//	  key_file: server-key.pem
+//	  ca_file: ca.pem
+//	acl_policy_file: policy.yaml
+//	auto_create_topics: true
+//	health: true
+//	reflection: true
+//	replicate_from: leader:8400
+type config struct {
+	DataDir  string `yaml:"data_dir"`
+	GRPCAddr string `yaml:"grpc_addr"`
+	HTTPAddr string `yaml:"http_addr"`
+	LogLevel string `yaml:"log_level"`
+	// ShutdownTimeout is how long the server waits for in-flight requests when it shuts down.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	Segment         struct {
+		MaxStoreBytes  uint64 `yaml:"max_store_bytes"`
+		MaxIndexBytes  uint64 `yaml:"max_index_bytes"`
+		MaxRecordBytes uint64 `yaml:"max_record_bytes"`
+	} `yaml:"segment"`
+	// Durability says when the logs sync appended records to disk: "never" (leave it to the
+	// OS), "every_append", "every_n" (every Records records) or "interval" (every Interval).
+	// See log.SyncPolicy for what each one can lose.
+	Durability struct {
+		Policy   string        `yaml:"policy"`
+		Records  uint64        `yaml:"records"`
+		Interval time.Duration `yaml:"interval"`
+	} `yaml:"durability"`
+	// Retention removes each log's oldest segments once the log is bigger than MaxBytes, or
+	// their latest records are older than MaxAge, checking every Interval. It always keeps the
+	// newest MinOffsets offsets. Leaving MaxBytes and MaxAge at zero keeps everything.
+	Retention struct {
+		MaxBytes   uint64        `yaml:"max_bytes"`
+		MaxAge     time.Duration `yaml:"max_age"`
+		MinOffsets uint64        `yaml:"min_offsets"`
+		Interval   time.Duration `yaml:"interval"`
+	} `yaml:"retention"`
+	// Compaction, when enabled, cleans each log's sealed segments every Interval so they only
+	// keep the latest record for each key, and drops tombstones after DeleteRetention.
+	Compaction struct {
+		Enabled         bool          `yaml:"enabled"`
+		DeleteRetention time.Duration `yaml:"delete_retention"`
+		Interval        time.Duration `yaml:"interval"`
+	} `yaml:"compaction"`
+	// TLS turns on TLS for both listeners when it has a certificate and key. With
+	// a CA file, the servers also ask for and verify client certificates.
+	TLS struct {
+		CertFile string `yaml:"cert_file"`
+		KeyFile  string `yaml:"key_file"`
+		CAFile   string `yaml:"ca_file"`
+	} `yaml:"tls"`
+	// ACLPolicyFile is the authorization policy (see auth.Policy). Without one, every
+	// client may do everything. Send the server SIGHUP to reload it.
+	ACLPolicyFile string `yaml:"acl_policy_file"`
+	// AutoCreateTopics creates topics the first time a client uses them. Otherwise
+	// admins create them with the CreateTopic RPC.
+	AutoCreateTopics bool `yaml:"auto_create_topics"`
+	// Health and Reflection register the gRPC health and reflection services.
+	Health     bool `yaml:"health"`
+	Reflection bool `yaml:"reflection"`
+	// ReplicateFrom, when set, makes the server a read-only follower of the server at that
+	// gRPC address: it replicates the leader's topics, with the server's TLS certificate
+	// when it has one, instead of taking writes of its own.
+	ReplicateFrom string `yaml:"replicate_from"`
+}
+
+// defaultConfig returns the config the server runs with when neither the file nor the flags say otherwise.
+func defaultConfig() config {
+	c := config{
+		DataDir:          "data",
+		GRPCAddr:         ":8400",
+		HTTPAddr:         ":8080",
+		LogLevel:         "info",
+		ShutdownTimeout:  10 * time.Second,
+		AutoCreateTopics: true,
+		Health:           true,
+		Reflection:       true,
+	}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	c.Segment.MaxRecordBytes = 1 << 20
+	c.Durability.Policy = "never"
+	return c
+}
+
+// syncPolicies are the durability policies by the names the config gives them.
+var syncPolicies = map[string]plog.SyncPolicy{
+	"never":        plog.SyncNever,
+	"every_append": plog.SyncEveryAppend,
+	"every_n":      plog.SyncEveryN,
+	"interval":     plog.SyncInterval,
+}
+
+// logConfig returns the config of the topics' logs.
+func (c config) logConfig() plog.Config {
+	lc := plog.Config{}
+	lc.Segment.MaxStoreBytes = c.Segment.MaxStoreBytes
+	lc.Segment.MaxIndexBytes = c.Segment.MaxIndexBytes
+	lc.Segment.MaxRecordBytes = c.Segment.MaxRecordBytes
+	lc.Durability.Policy = syncPolicies[c.Durability.Policy]
+	lc.Durability.Records = c.Durability.Records
+	lc.Durability.Interval = c.Durability.Interval
+	lc.Retention.MaxBytes = c.Retention.MaxBytes
+	lc.Retention.MaxAge = c.Retention.MaxAge
+	lc.Retention.MinOffsets = c.Retention.MinOffsets
+	lc.Retention.Interval = c.Retention.Interval
+	lc.Compaction.Enabled = c.Compaction.Enabled
+	lc.Compaction.DeleteRetention = c.Compaction.DeleteRetention
+	lc.Compaction.Interval = c.Compaction.Interval
+	return lc
+}
+
+// parseConfig builds the config from the command line arguments (without the program name):
+// the defaults, then the config file, if any, then the flags that were set.
+func parseConfig(args []string) (config, error) {
+	c := defaultConfig()
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	path := fs.String("config", "", "path to a YAML config file")
+	var f config
+	fs.StringVar(&f.DataDir, "data-dir", c.DataDir, "directory to store the log in")
+	fs.StringVar(&f.GRPCAddr, "grpc-addr", c.GRPCAddr, "address to serve gRPC on")
+	fs.StringVar(&f.HTTPAddr, "http-addr", c.HTTPAddr, "address to serve JSON/HTTP on")
+	fs.StringVar(&f.LogLevel, "log-level", c.LogLevel, "log level (debug, info, warn, error)")
+	fs.DurationVar(&f.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long to wait for in-flight requests on shutdown")
+	fs.Uint64Var(&f.Segment.MaxStoreBytes, "segment-max-store-bytes", c.Segment.MaxStoreBytes, "max size of a segment's store")
+	fs.Uint64Var(&f.Segment.MaxIndexBytes, "segment-max-index-bytes", c.Segment.MaxIndexBytes, "max size of a segment's index")
+	fs.Uint64Var(&f.Segment.MaxRecordBytes, "segment-max-record-bytes", c.Segment.MaxRecordBytes, "max size of a record")
+	fs.StringVar(&f.Durability.Policy, "durability-policy", c.Durability.Policy, "when to sync records to disk (never, every_append, every_n, interval)")
+	fs.Uint64Var(&f.Durability.Records, "durability-records", 0, "records between syncs with every_n")
+	fs.DurationVar(&f.Durability.Interval, "durability-interval", 0, "time between syncs with interval")
+	fs.Uint64Var(&f.Retention.MaxBytes, "retention-max-bytes", 0, "max size of a log before it removes its oldest segments")
+	fs.DurationVar(&f.Retention.MaxAge, "retention-max-age", 0, "how long a log keeps a segment after its latest record")
+	fs.Uint64Var(&f.Retention.MinOffsets, "retention-min-offsets", 0, "newest offsets a log always keeps")
+	fs.DurationVar(&f.Retention.Interval, "retention-interval", 0, "time between retention checks")
+	fs.BoolVar(&f.Compaction.Enabled, "compaction", false, "compact logs down to the latest record for each key")
+	fs.DurationVar(&f.Compaction.DeleteRetention, "compaction-delete-retention", 0, "how long compaction keeps tombstones")
+	fs.DurationVar(&f.Compaction.Interval, "compaction-interval", 0, "time between compactions")
+	fs.StringVar(&f.TLS.CertFile, "tls-cert-file", "", "server certificate")
+	fs.StringVar(&f.TLS.KeyFile, "tls-key-file", "", "server certificate's key")
+	fs.StringVar(&f.TLS.CAFile, "tls-ca-file", "", "CA to verify client certificates with")
+	fs.StringVar(&f.ACLPolicyFile, "acl-policy-file", "", "authorization policy file")
+	fs.BoolVar(&f.AutoCreateTopics, "auto-create-topics", c.AutoCreateTopics, "create topics the first time clients use them")
+	fs.BoolVar(&f.Health, "health", c.Health, "serve the gRPC health service")
+	fs.BoolVar(&f.Reflection, "reflection", c.Reflection, "serve the gRPC reflection service")
+	fs.StringVar(&f.ReplicateFrom, "replicate-from", "", "gRPC address of a leader to follow")
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+	if *path != "" {
+		b, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return c, err
+		}
+		if err = yaml.Unmarshal(b, &c); err != nil {
+			return c, err
+		}
+	}
+	fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "data-dir":
+			c.DataDir = f.DataDir
+		case "grpc-addr":
+			c.GRPCAddr = f.GRPCAddr
+		case "http-addr":
+			c.HTTPAddr = f.HTTPAddr
+		case "log-level":
+			c.LogLevel = f.LogLevel
+		case "shutdown-timeout":
+			c.ShutdownTimeout = f.ShutdownTimeout
+		case "segment-max-store-bytes":
+			c.Segment.MaxStoreBytes = f.Segment.MaxStoreBytes
+		case "segment-max-index-bytes":
+			c.Segment.MaxIndexBytes = f.Segment.MaxIndexBytes
+		case "segment-max-record-bytes":
+			c.Segment.MaxRecordBytes = f.Segment.MaxRecordBytes
+		case "durability-policy":
+			c.Durability.Policy = f.Durability.Policy
+		case "durability-records":
+			c.Durability.Records = f.Durability.Records
+		case "durability-interval":
+			c.Durability.Interval = f.Durability.Interval
+		case "retention-max-bytes":
+			c.Retention.MaxBytes = f.Retention.MaxBytes
+		case "retention-max-age":
+			c.Retention.MaxAge = f.Retention.MaxAge
+		case "retention-min-offsets":
+			c.Retention.MinOffsets = f.Retention.MinOffsets
+		case "retention-interval":
+			c.Retention.Interval = f.Retention.Interval
+		case "compaction":
+			c.Compaction.Enabled = f.Compaction.Enabled
+		case "compaction-delete-retention":
+			c.Compaction.DeleteRetention = f.Compaction.DeleteRetention
+		case "compaction-interval":
+			c.Compaction.Interval = f.Compaction.Interval
+		case "tls-cert-file":
+			c.TLS.CertFile = f.TLS.CertFile
+		case "tls-key-file":
+			c.TLS.KeyFile = f.TLS.KeyFile
+		case "tls-ca-file":
+			c.TLS.CAFile = f.TLS.CAFile
+		case "acl-policy-file":
+			c.ACLPolicyFile = f.ACLPolicyFile
+		case "auto-create-topics":
+			c.AutoCreateTopics = f.AutoCreateTopics
+		case "health":
+			c.Health = f.Health
+		case "reflection":
+			c.Reflection = f.Reflection
+		case "replicate-from":
+			c.ReplicateFrom = f.ReplicateFrom
+		}
+	})
+	if _, ok := syncPolicies[c.Durability.Policy]; !ok {
+		return c, fmt.Errorf("unknown durability policy: %q", c.Durability.Policy)
+	}
+	return c, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	plog "github.com/hafizmfadli/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfig(t *testing.T) {
+	c, err := parseConfig(nil)
+	require.NoError(t, err)
+	require.Equal(t, defaultConfig(), c)
+
+	f, err := ioutil.TempFile("", "config-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`
+data_dir: /var/lib/proglog
+grpc_addr: ":9400"
+log_level: debug
+segment:
+  max_store_bytes: 2048
+tls:
+  cert_file: server.pem
+  key_file: server-key.pem
+reflection: false
+`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// the file overrides the defaults, and the flags override the file.
+	c, err = parseConfig([]string{
+		"-config", f.Name(),
+		"-grpc-addr", ":10400",
+		"-segment-max-index-bytes", "4096",
+		"-health=false",
+		"-replicate-from", "leader:8400",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "/var/lib/proglog", c.DataDir)
+	require.Equal(t, ":10400", c.GRPCAddr)
+	require.Equal(t, ":8080", c.HTTPAddr)
+	require.Equal(t, "debug", c.LogLevel)
+	require.Equal(t, uint64(2048), c.Segment.MaxStoreBytes)
+	require.Equal(t, uint64(4096), c.Segment.MaxIndexBytes)
+	require.Equal(t, "server.pem", c.TLS.CertFile)
+	require.Equal(t, "server-key.pem", c.TLS.KeyFile)
+	require.Equal(t, "", c.TLS.CAFile)
+	require.False(t, c.Health)
+	require.False(t, c.Reflection)
+	require.Equal(t, "leader:8400", c.ReplicateFrom)
+
+	_, err = parseConfig([]string{"-config", "missing.yaml"})
+	require.Error(t, err)
+}
+
+// TestLogConfig tests that the logs get the durability, retention and compaction settings
+// from the file and flags.
+func TestLogConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "config-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`
+segment:
+  max_store_bytes: 2048
+durability:
+  policy: every_n
+  records: 100
+retention:
+  max_bytes: 1073741824
+  max_age: 168h
+  interval: 30s
+compaction:
+  delete_retention: 1h
+`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	c, err := parseConfig([]string{
+		"-config", f.Name(),
+		"-durability-records", "10",
+		"-retention-min-offsets", "1000",
+		"-compaction",
+		"-compaction-interval", "5m",
+	})
+	require.NoError(t, err)
+	lc := c.logConfig()
+	require.Equal(t, uint64(2048), lc.Segment.MaxStoreBytes)
+	require.Equal(t, plog.SyncEveryN, lc.Durability.Policy)
+	require.Equal(t, uint64(10), lc.Durability.Records)
+	require.Equal(t, uint64(1<<30), lc.Retention.MaxBytes)
+	require.Equal(t, 168*time.Hour, lc.Retention.MaxAge)
+	require.Equal(t, uint64(1000), lc.Retention.MinOffsets)
+	require.Equal(t, 30*time.Second, lc.Retention.Interval)
+	require.True(t, lc.Compaction.Enabled)
+	require.Equal(t, time.Hour, lc.Compaction.DeleteRetention)
+	require.Equal(t, 5*time.Minute, lc.Compaction.Interval)
+
+	c, err = parseConfig([]string{"-durability-policy", "interval", "-durability-interval", "5ms"})
+	require.NoError(t, err)
+	lc = c.logConfig()
+	require.Equal(t, plog.SyncInterval, lc.Durability.Policy)
+	require.Equal(t, 5*time.Millisecond, lc.Durability.Interval)
+
+	// the log never syncs unless we ask it to.
+	c, err = parseConfig(nil)
+	require.NoError(t, err)
+	require.Equal(t, plog.SyncNever, c.logConfig().Durability.Policy)
+
+	_, err = parseConfig([]string{"-durability-policy", "sometimes"})
+	require.Error(t, err)
+}
@@ -1,12 +1,230 @@
 package main
 
 import (
+	"context"
 	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/hafizmfadli/proglog/internal/auth"
+	pconfig "github.com/hafizmfadli/proglog/internal/config"
+	"github.com/hafizmfadli/proglog/internal/group"
+	plog "github.com/hafizmfadli/proglog/internal/log"
 	"github.com/hafizmfadli/proglog/internal/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
-func main(){
-	srv := server.NewHTTPServer(":8080")
-	log.Fatal(srv.ListenAndServe())
-}
\ No newline at end of file
+// main opens the topics' logs from disk and serves them over both gRPC and JSON/HTTP,
+// so records produced through one front-end can be consumed through the other.
+func main() {
+	c, err := parseConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	if err = run(c, sigc); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run serves the topics as the config says until one of the servers fails or we get
+// a signal, and then shuts down gracefully: we stop accepting new requests, end the streams,
+// give in-flight requests until the shutdown timeout to finish, and close the logs, which flushes
+// every segment and truncates its index so the logs start up cleanly next time. SIGHUP doesn't
+// stop the server, it reloads the authorization policy.
+func run(c config, sigc <-chan os.Signal) (err error) {
+	logger, err := newLogger(c.LogLevel)
+	if err != nil {
+		return err
+	}
+	defer logger.Sync()
+	zap.ReplaceGlobals(logger)
+
+	if err = os.MkdirAll(c.DataDir, 0755); err != nil {
+		return err
+	}
+	// the log and the servers report to the same registry, which the HTTP server serves on /metrics.
+	registry := prometheus.NewRegistry()
+	logConfig := c.logConfig()
+	logConfig.Metrics.Registry = registry
+	// every topic has its own log, in a directory under the data directory. A follower's
+	// topics are the leader's, so it doesn't create any itself, or take writes.
+	follower := c.ReplicateFrom != ""
+	topics, err := plog.NewLogManager(c.DataDir, plog.ManagerConfig{
+		Log:              logConfig,
+		AutoCreateTopics: c.AutoCreateTopics && !follower,
+		ReadOnly:         follower,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := topics.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	// consumer groups share the partitions of the manager's topics. Joining a group doesn't
+	// create the topics it names, and the group doesn't get the ones that don't exist.
+	groups := group.NewCoordinator(group.Config{
+		Partitions: topics.PartitionCount,
+	})
+	defer groups.Close()
+
+	shutdown := make(chan struct{})
+	srvConfig := &server.Config{
+		Topics:     server.NewTopicManager(topics),
+		Offsets:    topics.Offsets(),
+		Groups:     groups,
+		Shutdown:   shutdown,
+		Metrics:    registry,
+		Health:     c.Health,
+		Reflection: c.Reflection,
+		Logger:     logger.Named("server"),
+	}
+	// TLS is on when we have a certificate and key, and the CA turns on mutual TLS.
+	if c.TLS.CertFile != "" || c.TLS.KeyFile != "" {
+		srvConfig.TLSConfig, err = pconfig.SetupTLSConfig(pconfig.TLSConfig{
+			CertFile: c.TLS.CertFile,
+			KeyFile:  c.TLS.KeyFile,
+			CAFile:   c.TLS.CAFile,
+			Server:   true,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if follower {
+		// the replicator closes before the topics, which we deferred closing first.
+		replicator, err := newReplicator(c, topics)
+		if err != nil {
+			return err
+		}
+		defer replicator.Close()
+		srvConfig.Replicator = replicator
+	}
+	var authorizer *auth.Authorizer
+	if c.ACLPolicyFile != "" {
+		if authorizer, err = auth.New(c.ACLPolicyFile); err != nil {
+			return err
+		}
+		srvConfig.Authorizer = authorizer
+	}
+	tlsConfig := srvConfig.TLSConfig
+	gsrv, err := server.NewGRPCServer(srvConfig)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", c.GRPCAddr)
+	if err != nil {
+		return err
+	}
+	httpsrv := server.NewHTTPServer(c.HTTPAddr, srvConfig)
+
+	errc := make(chan error, 2)
+	go func() {
+		errc <- gsrv.Serve(ln)
+	}()
+	go func() {
+		if tlsConfig != nil {
+			errc <- httpsrv.ListenAndServeTLS("", "")
+			return
+		}
+		errc <- httpsrv.ListenAndServe()
+	}()
+	logger.Info(
+		"serving",
+		zap.String("data_dir", c.DataDir),
+		zap.String("grpc_addr", ln.Addr().String()),
+		zap.String("http_addr", c.HTTPAddr),
+		zap.Bool("tls", tlsConfig != nil),
+	)
+wait:
+	for {
+		select {
+		case err = <-errc:
+			gsrv.Stop()
+			httpsrv.Close()
+			return err
+		case sig := <-sigc:
+			if sig != syscall.SIGHUP {
+				logger.Info("shutting down", zap.String("signal", sig.String()))
+				break wait
+			}
+			// SIGHUP reloads the authorization policy.
+			if authorizer == nil {
+				continue
+			}
+			if err := authorizer.Reload(); err != nil {
+				logger.Error("failed to reload policy", zap.Error(err))
+				continue
+			}
+			logger.Info("reloaded policy", zap.String("file", c.ACLPolicyFile))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+	defer cancel()
+	close(shutdown)
+	stopped := make(chan struct{})
+	go func() {
+		gsrv.GracefulStop()
+		close(stopped)
+	}()
+	if err = httpsrv.Shutdown(ctx); err != nil {
+		httpsrv.Close()
+	}
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		logger.Warn("shutdown timed out, cancelling in-flight requests")
+		gsrv.Stop()
+		<-stopped
+	}
+	return nil
+}
+
+// newReplicator starts replicating the leader's topics to ours. We connect to the leader with
+// the server's certificate, verified by the CA, when we serve over TLS.
+func newReplicator(c config, topics *plog.LogManager) (*plog.Replicator, error) {
+	creds := grpc.WithInsecure()
+	if c.TLS.CertFile != "" || c.TLS.KeyFile != "" {
+		host, _, err := net.SplitHostPort(c.ReplicateFrom)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig, err := pconfig.SetupTLSConfig(pconfig.TLSConfig{
+			CertFile:      c.TLS.CertFile,
+			KeyFile:       c.TLS.KeyFile,
+			CAFile:        c.TLS.CAFile,
+			ServerAddress: host,
+		})
+		if err != nil {
+			return nil, err
+		}
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	}
+	return plog.NewReplicator(plog.ReplicatorConfig{
+		Leader:      c.ReplicateFrom,
+		DialOptions: []grpc.DialOption{creds},
+		Manager:     topics,
+	})
+}
+
+// newLogger builds a production logger that logs at the given level.
+func newLogger(level string) (*zap.Logger, error) {
+	var l zapcore.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	zc := zap.NewProductionConfig()
+	zc.Level = zap.NewAtomicLevelAt(l)
+	return zc.Build()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestRunShutdown tests that the server shuts down on a signal and closes the log,
+// which truncates the segment's index back to its entries.
+func TestRunShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := defaultConfig()
+	c.DataDir = dir
+	c.GRPCAddr = "127.0.0.1:0"
+	c.HTTPAddr = "127.0.0.1:0"
+	c.LogLevel = "error"
+	sigc := make(chan os.Signal, 1)
+	done := make(chan error)
+	go func() {
+		done <- run(c, sigc)
+	}()
+
+	index := filepath.Join(dir, "default", "0", "0.index")
+	require.Eventually(t, func() bool {
+		fi, err := os.Stat(index)
+		return err == nil && uint64(fi.Size()) == c.Segment.MaxIndexBytes
+	}, time.Second, 10*time.Millisecond)
+
+	sigc <- syscall.SIGTERM
+	require.NoError(t, <-done)
+	fi, err := os.Stat(index)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), fi.Size())
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// The actions a policy grants.
+const (
+	Produce = "produce"
+	Consume = "consume"
+	Admin   = "admin"
+)
+
+// Wildcard is the subject that matches every client, authenticated or not.
+const Wildcard = "*"
+
+// Policy says what each subject may do. A rule grants its subject the actions, on the
+// given topics or, without topics, on every topic. Subjects get every action any of
+// their rules (and the wildcard's rules) grant:
+//
+//	rules:
+//	  - subject: root
+//	    actions: [produce, consume, admin]
+//	  - subject: billing
+//	    actions: [consume]
+//	    topics: [invoices]
+//	  - subject: "*"
+//	    actions: [consume]
+//	    topics: [public]
+type Policy struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule grants a subject actions, optionally only on some topics.
+type Rule struct {
+	Subject string   `yaml:"subject"`
+	Actions []string `yaml:"actions"`
+	Topics  []string `yaml:"topics"`
+}
+
+// Authorizer decides whether subjects may perform actions according to a policy file.
+// You can reload the file while the server runs, and the authorizer switches to the new policy
+// once it has read it in full, so requests never see half a policy.
+type Authorizer struct {
+	file string
+
+	mu     sync.RWMutex
+	policy Policy
+}
+
+// New creates an authorizer with the policy in the given file.
+func New(policyFile string) (*Authorizer, error) {
+	a := &Authorizer{file: policyFile}
+	return a, a.Reload()
+}
+
+// Reload reads the policy file again. If it fails, the authorizer keeps the policy it had.
+func (a *Authorizer) Reload() error {
+	b, err := ioutil.ReadFile(a.file)
+	if err != nil {
+		return err
+	}
+	var p Policy
+	if err = yaml.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	for _, r := range p.Rules {
+		for _, action := range r.Actions {
+			switch action {
+			case Produce, Consume, Admin:
+			default:
+				return fmt.Errorf("policy: unknown action %q for %q", action, r.Subject)
+			}
+		}
+	}
+	a.mu.Lock()
+	a.policy = p
+	a.mu.Unlock()
+	return nil
+}
+
+// Authorize returns nil if the subject may perform the action on the topic, and a
+// codes.PermissionDenied error if it may not.
+func (a *Authorizer) Authorize(subject, topic, action string) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, r := range a.policy.Rules {
+		if r.Subject != subject && r.Subject != Wildcard {
+			continue
+		}
+		if contains(r.Actions, action) && (len(r.Topics) == 0 || contains(r.Topics, topic)) {
+			return nil
+		}
+	}
+	msg := fmt.Sprintf("%q is not permitted to %s", subject, action)
+	if topic != "" {
+		msg += fmt.Sprintf(" on topic %q", topic)
+	}
+	return status.Error(codes.PermissionDenied, msg)
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
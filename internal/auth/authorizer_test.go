@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const policy = `
+rules:
+  - subject: root
+    actions: [produce, consume, admin]
+  - subject: billing
+    actions: [consume]
+    topics: [invoices]
+  - subject: "*"
+    actions: [consume]
+    topics: [public]
+`
+
+func TestAuthorizer(t *testing.T) {
+	f, err := ioutil.TempFile("", "policy-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(policy)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	a, err := New(f.Name())
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		subject, topic, action string
+		allowed                bool
+	}{
+		{"root", "", Produce, true},
+		{"root", "invoices", Admin, true},
+		{"billing", "invoices", Consume, true},
+		{"billing", "invoices", Produce, false},
+		{"billing", "orders", Consume, false},
+		{"billing", "public", Consume, true},
+		{"nobody", "public", Consume, true},
+		{"nobody", "", Consume, false},
+		{"", "", Produce, false},
+	} {
+		err := a.Authorize(tc.subject, tc.topic, tc.action)
+		if tc.allowed {
+			require.NoError(t, err, "%+v", tc)
+			continue
+		}
+		require.Equal(t, codes.PermissionDenied, status.Code(err), "%+v", tc)
+	}
+
+	// reloading picks up the new policy, and a bad policy leaves the old one in place.
+	require.NoError(t, ioutil.WriteFile(f.Name(), []byte(`
+rules:
+  - subject: billing
+    actions: [produce]
+`), 0644))
+	require.NoError(t, a.Reload())
+	require.NoError(t, a.Authorize("billing", "orders", Produce))
+	require.Error(t, a.Authorize("root", "", Produce))
+
+	require.NoError(t, ioutil.WriteFile(f.Name(), []byte(`
+rules:
+  - subject: root
+    actions: [delete]
+`), 0644))
+	require.Error(t, a.Reload())
+	require.NoError(t, a.Authorize("billing", "orders", Produce))
+}
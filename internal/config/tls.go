@@ -0,0 +1,54 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSConfig says where to find the files we build a *tls.Config from, and who it's for.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// CAFile is the CA we verify the other side's certificate with. A server with
+	// a CA asks for and verifies client certificates (mutual TLS).
+	CAFile string
+	// ServerAddress is the name a client expects in the server's certificate.
+	ServerAddress string
+	Server        bool
+}
+
+// SetupTLSConfig builds a *tls.Config from the given files. A server presents its certificate
+// and, with a CA, requires clients to present a certificate signed by it. A client verifies the
+// server's certificate with the CA (or the system's CAs without one) and presents its own
+// certificate if it has one.
+func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	var err error
+	tc := &tls.Config{}
+	if cfg.CertFile != "" && cfg.KeyFile != "" {
+		tc.Certificates = make([]tls.Certificate, 1)
+		tc.Certificates[0], err = tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.CAFile != "" {
+		b, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		ca := x509.NewCertPool()
+		if !ca.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("failed to parse root certificate: %q", cfg.CAFile)
+		}
+		if cfg.Server {
+			tc.ClientCAs = ca
+			tc.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			tc.RootCAs = ca
+		}
+	}
+	tc.ServerName = cfg.ServerAddress
+	return tc, nil
+}
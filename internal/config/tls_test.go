@@ -0,0 +1,47 @@
+package config
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hafizmfadli/proglog/internal/testca"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca, err := testca.New(dir)
+	require.NoError(t, err)
+	certFile, keyFile, err := ca.Issue("server", true)
+	require.NoError(t, err)
+
+	server, err := SetupTLSConfig(TLSConfig{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		CAFile:   ca.CertFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(server.Certificates))
+	require.NotNil(t, server.ClientCAs)
+	require.Nil(t, server.RootCAs)
+	require.Equal(t, tls.RequireAndVerifyClientCert, server.ClientAuth)
+
+	client, err := SetupTLSConfig(TLSConfig{
+		CAFile:        ca.CertFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	require.Equal(t, 0, len(client.Certificates))
+	require.NotNil(t, client.RootCAs)
+	require.Equal(t, "127.0.0.1", client.ServerName)
+
+	_, err = SetupTLSConfig(TLSConfig{CAFile: certFile + ".missing"})
+	require.Error(t, err)
+	_, err = SetupTLSConfig(TLSConfig{CAFile: keyFile})
+	require.Error(t, err)
+}
@@ -0,0 +1,132 @@
+package group
+
+import (
+	"sort"
+)
+
+// Strategy is how a group splits the partitions of the topics its members consume among them.
+type Strategy int
+
+const (
+	// Range gives each member, topic by topic, a contiguous range of the topic's partitions.
+	// With 3 partitions and 2 members, the first member gets partitions 0 and 1 and the second
+	// gets partition 2. Members consuming several topics with the same partitions get the same
+	// partitions of each, which suits consumers that join topics by partition.
+	Range Strategy = iota
+	// RoundRobin deals the partitions of every topic out to the members in turn, which
+	// spreads them more evenly when the group consumes many topics.
+	RoundRobin
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case Range:
+		return "range"
+	case RoundRobin:
+		return "roundrobin"
+	}
+	return "unknown"
+}
+
+// Assignment is the partitions of each topic that a member consumes.
+type Assignment map[string][]uint32
+
+// Member is a member of a group, along with the topics it consumes.
+type Member struct {
+	ID     string
+	Topics []string
+}
+
+// Assign splits the partitions among the members with the strategy, and returns each member's
+// assignment by its ID. partitions says how many partitions each topic has. Every partition of a
+// topic goes to exactly one of the members consuming the topic, and each member's partitions are sorted.
+func Assign(strategy Strategy, members []Member, partitions map[string]uint32) map[string]Assignment {
+	members = append([]Member(nil), members...)
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ID < members[j].ID
+	})
+	assignments := make(map[string]Assignment, len(members))
+	for _, m := range members {
+		assignments[m.ID] = make(Assignment)
+	}
+	// consumers lists the members consuming each topic, sorted by ID.
+	consumers := make(map[string][]string)
+	for _, m := range members {
+		for _, topic := range m.Topics {
+			if _, ok := partitions[topic]; ok && !contains(consumers[topic], m.ID) {
+				consumers[topic] = append(consumers[topic], m.ID)
+			}
+		}
+	}
+	topics := make([]string, 0, len(consumers))
+	for topic := range consumers {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	switch strategy {
+	case RoundRobin:
+		var next int
+		for _, topic := range topics {
+			for p := uint32(0); p < partitions[topic]; p++ {
+				// the next member in turn that consumes the topic gets the partition.
+				for !contains(consumers[topic], members[next%len(members)].ID) {
+					next++
+				}
+				id := members[next%len(members)].ID
+				assignments[id][topic] = append(assignments[id][topic], p)
+				next++
+			}
+		}
+	default:
+		for _, topic := range topics {
+			ids := consumers[topic]
+			n := partitions[topic] / uint32(len(ids))
+			extra := partitions[topic] % uint32(len(ids))
+			var p uint32
+			for i, id := range ids {
+				size := n
+				if uint32(i) < extra {
+					size++
+				}
+				for end := p + size; p < end; p++ {
+					assignments[id][topic] = append(assignments[id][topic], p)
+				}
+			}
+		}
+	}
+	return assignments
+}
+
+// contains returns whether the IDs contain the ID.
+func contains(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// minus returns the partitions in a that aren't in b.
+func (a Assignment) minus(b Assignment) Assignment {
+	diff := make(Assignment)
+	for topic, partitions := range a {
+		for _, p := range partitions {
+			if !containsPartition(b[topic], p) {
+				diff[topic] = append(diff[topic], p)
+			}
+		}
+	}
+	return diff
+}
+
+// containsPartition returns whether the partitions contain p.
+func containsPartition(partitions []uint32, p uint32) bool {
+	for _, q := range partitions {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package group
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssign(t *testing.T) {
+	partitions := map[string]uint32{"orders": 3, "payments": 2}
+	for scenario, tc := range map[string]struct {
+		strategy Strategy
+		members  []Member
+		want     map[string]Assignment
+	}{
+		"range splits each topic into contiguous ranges": {
+			strategy: Range,
+			members: []Member{
+				{ID: "b", Topics: []string{"orders", "payments"}},
+				{ID: "a", Topics: []string{"orders", "payments"}},
+			},
+			want: map[string]Assignment{
+				"a": {"orders": {0, 1}, "payments": {0}},
+				"b": {"orders": {2}, "payments": {1}},
+			},
+		},
+		"round robin deals every partition in turn": {
+			strategy: RoundRobin,
+			members: []Member{
+				{ID: "a", Topics: []string{"orders", "payments"}},
+				{ID: "b", Topics: []string{"orders", "payments"}},
+			},
+			want: map[string]Assignment{
+				"a": {"orders": {0, 2}, "payments": {1}},
+				"b": {"orders": {1}, "payments": {0}},
+			},
+		},
+		"round robin skips members that don't consume the topic": {
+			strategy: RoundRobin,
+			members: []Member{
+				{ID: "a", Topics: []string{"orders"}},
+				{ID: "b", Topics: []string{"orders", "payments"}},
+			},
+			want: map[string]Assignment{
+				"a": {"orders": {0, 2}},
+				"b": {"orders": {1}, "payments": {0, 1}},
+			},
+		},
+		"more members than partitions leaves some idle": {
+			strategy: Range,
+			members: []Member{
+				{ID: "a", Topics: []string{"payments"}},
+				{ID: "b", Topics: []string{"payments"}},
+				{ID: "c", Topics: []string{"payments"}},
+			},
+			want: map[string]Assignment{
+				"a": {"payments": {0}},
+				"b": {"payments": {1}},
+				"c": {},
+			},
+		},
+		"unknown topics have no partitions": {
+			strategy: Range,
+			members:  []Member{{ID: "a", Topics: []string{"shipments"}}},
+			want:     map[string]Assignment{"a": {}},
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			require.Equal(t, tc.want, Assign(tc.strategy, tc.members, partitions))
+		})
+	}
+}
+
+func TestAssignmentMinus(t *testing.T) {
+	a := Assignment{"orders": {0, 1, 2}, "payments": {0}}
+	b := Assignment{"orders": {1}}
+	require.Equal(t, Assignment{"orders": {0, 2}, "payments": {0}}, a.minus(b))
+	require.Equal(t, Assignment{}, b.minus(a))
+}
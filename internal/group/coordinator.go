@@ -0,0 +1,323 @@
+package group
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"go.uber.org/zap"
+)
+
+// Config configures a Coordinator.
+type Config struct {
+	// Partitions returns how many partitions the topic has. The coordinator doesn't assign
+	// the partitions of topics it returns an error for. It's called with the coordinator's
+	// lock held, while rebalancing, so it should only look the topic up, not create it.
+	Partitions func(topic string) (uint32, error)
+	// SessionTimeout is how long a member stays in its group without a heartbeat, when it
+	// doesn't ask for its own. Defaults to 10 seconds.
+	SessionTimeout time.Duration
+	// MaxSessionTimeout is the longest session timeout members may ask for. Defaults to 5 minutes.
+	MaxSessionTimeout time.Duration
+}
+
+// Coordinator keeps track of the members of consumer groups and which partitions each
+// consumes. Members join a group with the topics they want to consume, and stay in it as long
+// as they send heartbeats. Whenever a member joins or leaves, or goes quiet for longer than its
+// session timeout, the coordinator rebalances the group: it splits the partitions among the
+// members again, with the group's strategy, and starts a new generation of the group. Members
+// find out about their new assignment, and the partitions they lost, with Membership.Next.
+type Coordinator struct {
+	Config Config
+
+	mu     sync.Mutex
+	groups map[string]*group
+	closed bool
+}
+
+type group struct {
+	name       string
+	strategy   Strategy
+	generation uint64
+	members    map[string]*member
+}
+
+type member struct {
+	id      string
+	topics  []string
+	timeout time.Duration
+	// the member leaves the group when timer fires after deadline.
+	timer    *time.Timer
+	deadline time.Time
+
+	// assignment is the member's partitions in generation, and changed is closed (and
+	// replaced) when they change. left says the member isn't in the group anymore.
+	generation uint64
+	assignment Assignment
+	changed    chan struct{}
+	left       bool
+}
+
+// Notification tells a member about a rebalance of its group: the partitions it consumes
+// in the new generation, and the partitions it consumed before that it has to stop consuming.
+type Notification struct {
+	Generation uint64
+	Assigned   Assignment
+	Revoked    Assignment
+}
+
+// NewCoordinator returns a coordinator with the config.
+func NewCoordinator(c Config) *Coordinator {
+	if c.SessionTimeout == 0 {
+		c.SessionTimeout = 10 * time.Second
+	}
+	if c.MaxSessionTimeout == 0 {
+		c.MaxSessionTimeout = 5 * time.Minute
+	}
+	return &Coordinator{
+		Config: c,
+		groups: make(map[string]*group),
+	}
+}
+
+// Join adds a new member, consuming the topics, to the group, and rebalances the group. The
+// first member of a group picks its strategy, and later members have to use the same one or
+// Join returns api.ErrInconsistentStrategy. A session timeout of 0 is the coordinator's default.
+func (c *Coordinator) Join(name string, topics []string, strategy Strategy, sessionTimeout time.Duration) (*Membership, error) {
+	if sessionTimeout == 0 {
+		sessionTimeout = c.Config.SessionTimeout
+	}
+	if sessionTimeout > c.Config.MaxSessionTimeout {
+		sessionTimeout = c.Config.MaxSessionTimeout
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, api.ErrCoordinatorClosed{}
+	}
+	g, ok := c.groups[name]
+	if !ok {
+		g = &group{
+			name:     name,
+			strategy: strategy,
+			members:  make(map[string]*member),
+		}
+		c.groups[name] = g
+	}
+	if g.strategy != strategy {
+		return nil, api.ErrInconsistentStrategy{Group: name, Strategy: g.strategy.String()}
+	}
+	m := &member{
+		id:       newMemberID(),
+		topics:   topics,
+		timeout:  sessionTimeout,
+		deadline: time.Now().Add(sessionTimeout),
+		changed:  make(chan struct{}),
+	}
+	m.timer = time.AfterFunc(sessionTimeout, func() {
+		c.expire(name, m)
+	})
+	g.members[m.id] = m
+	c.rebalance(g)
+	return &Membership{ID: m.id, Group: name, c: c, m: m}, nil
+}
+
+// Heartbeat keeps the member in its group for another session timeout, and returns the
+// group's generation, so the member can tell whether it missed a rebalance. It returns
+// api.ErrUnknownMember if the member isn't in the group, for example because it went quiet
+// for too long, in which case the member has to join again.
+func (c *Coordinator) Heartbeat(name, id string) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, err := c.member(name, id)
+	if err != nil {
+		return 0, err
+	}
+	m.deadline = time.Now().Add(m.timeout)
+	m.timer.Reset(m.timeout)
+	return c.groups[name].generation, nil
+}
+
+// Topics returns the topics the member consumes, so the server can check the client may
+// consume them before it lets the client act for the member. It returns api.ErrUnknownMember
+// if the member isn't in the group.
+func (c *Coordinator) Topics(name, id string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, err := c.member(name, id)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string(nil), m.topics...), nil
+}
+
+// Leave removes the member from its group and rebalances the group. It returns
+// api.ErrUnknownMember if the member isn't in the group.
+func (c *Coordinator) Leave(name, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, err := c.member(name, id)
+	if err != nil {
+		return err
+	}
+	c.remove(c.groups[name], m)
+	return nil
+}
+
+// Close removes every member from its group, which ends their memberships.
+func (c *Coordinator) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, g := range c.groups {
+		for _, m := range g.members {
+			m.timer.Stop()
+			m.leave()
+		}
+	}
+	c.groups = make(map[string]*group)
+	return nil
+}
+
+// member returns the member of the group. The caller must hold the lock.
+func (c *Coordinator) member(name, id string) (*member, error) {
+	if c.closed {
+		return nil, api.ErrCoordinatorClosed{}
+	}
+	g, ok := c.groups[name]
+	if !ok {
+		return nil, api.ErrUnknownMember{Group: name, MemberID: id}
+	}
+	m, ok := g.members[id]
+	if !ok {
+		return nil, api.ErrUnknownMember{Group: name, MemberID: id}
+	}
+	return m, nil
+}
+
+// expire removes the member from its group when its session times out.
+func (c *Coordinator) expire(name string, m *member) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, ok := c.groups[name]
+	// the member may have left, or sent a heartbeat, while the timer fired.
+	if !ok || g.members[m.id] != m || time.Now().Before(m.deadline) {
+		return
+	}
+	zap.L().Named("group").Info(
+		"member session expired",
+		zap.String("group", name),
+		zap.String("member_id", m.id),
+	)
+	c.remove(g, m)
+}
+
+// remove removes the member from the group and rebalances what's left of it. A group
+// without members goes away, and the next member to join picks its strategy again.
+// The caller must hold the lock.
+func (c *Coordinator) remove(g *group, m *member) {
+	m.timer.Stop()
+	m.leave()
+	delete(g.members, m.id)
+	if len(g.members) == 0 {
+		delete(c.groups, g.name)
+		return
+	}
+	c.rebalance(g)
+}
+
+// rebalance assigns the partitions among the group's members and starts the group's next
+// generation. The caller must hold the lock.
+func (c *Coordinator) rebalance(g *group) {
+	g.generation++
+	members := make([]Member, 0, len(g.members))
+	partitions := make(map[string]uint32)
+	for _, m := range g.members {
+		members = append(members, Member{ID: m.id, Topics: m.topics})
+		for _, topic := range m.topics {
+			if _, ok := partitions[topic]; ok {
+				continue
+			}
+			if n, err := c.Config.Partitions(topic); err == nil {
+				partitions[topic] = n
+			}
+		}
+	}
+	for id, a := range Assign(g.strategy, members, partitions) {
+		m := g.members[id]
+		m.generation = g.generation
+		m.assignment = a
+		close(m.changed)
+		m.changed = make(chan struct{})
+	}
+	zap.L().Named("group").Info(
+		"rebalanced group",
+		zap.String("group", g.name),
+		zap.Uint64("generation", g.generation),
+		zap.Int("members", len(g.members)),
+		zap.String("strategy", g.strategy.String()),
+	)
+}
+
+// leave marks the member as gone, and wakes it up so it finds out. The caller must hold the lock.
+func (m *member) leave() {
+	if m.left {
+		return
+	}
+	m.left = true
+	close(m.changed)
+}
+
+// Membership is a member's place in its group.
+type Membership struct {
+	// ID is the member's ID, which it sends along with its heartbeats.
+	ID    string
+	Group string
+
+	c *Coordinator
+	m *member
+	// the generation and assignment Next last returned.
+	generation uint64
+	assignment Assignment
+}
+
+// Next waits for the next generation of the member's group, and returns the member's
+// partitions in it, along with the partitions it had before that it doesn't anymore. The
+// first call returns the assignment of the generation the member joined in (or a later one).
+// Next returns api.ErrUnknownMember once the member is no longer in the group, and the
+// context's error if it's done first.
+func (ms *Membership) Next(ctx context.Context) (Notification, error) {
+	c, m := ms.c, ms.m
+	for {
+		c.mu.Lock()
+		left, generation, assignment, changed := m.left, m.generation, m.assignment, m.changed
+		c.mu.Unlock()
+		switch {
+		case left:
+			return Notification{}, api.ErrUnknownMember{Group: ms.Group, MemberID: ms.ID}
+		case generation > ms.generation:
+			n := Notification{
+				Generation: generation,
+				Assigned:   assignment,
+				Revoked:    ms.assignment.minus(assignment),
+			}
+			ms.generation, ms.assignment = generation, assignment
+			return n, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return Notification{}, ctx.Err()
+		}
+	}
+}
+
+// newMemberID returns a random member ID.
+func newMemberID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
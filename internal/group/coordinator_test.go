@@ -0,0 +1,115 @@
+package group
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCoordinator() *Coordinator {
+	return NewCoordinator(Config{
+		Partitions: func(topic string) (uint32, error) {
+			if topic != "orders" {
+				return 0, api.ErrTopicNotFound{Topic: topic}
+			}
+			return 4, nil
+		},
+	})
+}
+
+func TestCoordinator(t *testing.T) {
+	c := newTestCoordinator()
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	a, err := c.Join("billing", []string{"orders"}, Range, 0)
+	require.NoError(t, err)
+	n, err := a.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, Notification{
+		Generation: 1,
+		Assigned:   Assignment{"orders": {0, 1, 2, 3}},
+		Revoked:    Assignment{},
+	}, n)
+
+	_, err = c.Join("billing", []string{"orders"}, RoundRobin, 0)
+	require.Equal(t, api.ErrInconsistentStrategy{Group: "billing", Strategy: "range"}, err)
+
+	// a second member takes half the partitions off the first.
+	b, err := c.Join("billing", []string{"orders"}, Range, 0)
+	require.NoError(t, err)
+	na, err := a.Next(ctx)
+	require.NoError(t, err)
+	nb, err := b.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), na.Generation)
+	require.Equal(t, uint64(2), nb.Generation)
+	require.Len(t, na.Assigned["orders"], 2)
+	require.Len(t, nb.Assigned["orders"], 2)
+	require.Equal(t, nb.Assigned, na.Revoked)
+
+	generation, err := c.Heartbeat("billing", a.ID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), generation)
+	topics, err := c.Topics("billing", a.ID)
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders"}, topics)
+	_, err = c.Topics("billing", "nobody")
+	require.Equal(t, api.ErrUnknownMember{Group: "billing", MemberID: "nobody"}, err)
+
+	// when it leaves, the first member gets them back.
+	require.NoError(t, c.Leave("billing", b.ID))
+	_, err = b.Next(ctx)
+	require.Equal(t, api.ErrUnknownMember{Group: "billing", MemberID: b.ID}, err)
+	n, err = a.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), n.Generation)
+	require.Equal(t, Assignment{"orders": {0, 1, 2, 3}}, n.Assigned)
+	require.Equal(t, api.ErrUnknownMember{Group: "billing", MemberID: b.ID}, c.Leave("billing", b.ID))
+
+	// Next waits for the next rebalance.
+	short, cancelShort := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancelShort()
+	_, err = a.Next(short)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	require.NoError(t, c.Close())
+	_, err = a.Next(ctx)
+	require.Equal(t, api.ErrUnknownMember{Group: "billing", MemberID: a.ID}, err)
+	_, err = c.Join("billing", []string{"orders"}, Range, 0)
+	require.Equal(t, api.ErrCoordinatorClosed{}, err)
+}
+
+func TestCoordinatorSessionTimeout(t *testing.T) {
+	c := newTestCoordinator()
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	a, err := c.Join("billing", []string{"orders"}, RoundRobin, time.Hour)
+	require.NoError(t, err)
+	b, err := c.Join("billing", []string{"orders"}, RoundRobin, 50*time.Millisecond)
+	require.NoError(t, err)
+	n, err := a.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), n.Generation)
+
+	// heartbeats keep the member in the group past its session timeout.
+	for i := 0; i < 4; i++ {
+		time.Sleep(25 * time.Millisecond)
+		_, err = c.Heartbeat("billing", b.ID)
+		require.NoError(t, err)
+	}
+
+	// and without them it leaves, and the group rebalances.
+	n, err = a.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), n.Generation)
+	require.Equal(t, Assignment{"orders": {0, 1, 2, 3}}, n.Assigned)
+	_, err = c.Heartbeat("billing", b.ID)
+	require.Equal(t, api.ErrUnknownMember{Group: "billing", MemberID: b.ID}, err)
+}
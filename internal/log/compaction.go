@@ -0,0 +1,244 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"go.uber.org/zap"
+)
+
+// compactDir is the directory in the log's directory where compaction writes cleaned
+// segments before they replace the originals. Its name isn't an offset, so setup skips it.
+const compactDir = "compact"
+
+// CompactedSegment describes a segment the log cleaned, and how much compaction
+// removed from it.
+type CompactedSegment struct {
+	BaseOffset     uint64
+	NextOffset     uint64
+	RecordsRemoved uint64
+	BytesBefore    uint64
+	BytesAfter     uint64
+}
+
+// Compact cleans the log's sealed segments so they only keep the latest record for
+// each key, and returns the segments it cleaned. The log calls it in the background every
+// Compaction.Interval when compaction is enabled, but you can call it yourself too.
+//
+// Compaction keeps the records' offsets, so a compacted log has gaps: reading a removed
+// offset returns the next record in the log. A record with a key and an empty value is a
+// tombstone, which says the key was deleted. Compaction keeps the latest tombstone for a key for
+// Compaction.DeleteRetention so consumers see the deletion, and removes it after that. The active
+// segment is still changing, so compaction leaves it alone: a key's records only make its older
+// records go once they're sealed.
+//
+// Sealed segments don't change, so compaction reads and copies them without the log's lock,
+// and appends and reads carry on meanwhile. It only takes the lock to swap a cleaned segment in.
+// Everything that closes segments waits for compaction to finish first, so they stay open.
+func (l *Log) Compact() ([]CompactedSegment, error) {
+	l.compacting.Lock()
+	defer l.compacting.Unlock()
+	sealed, ends, err := l.sealedSegments()
+	if err != nil {
+		return nil, err
+	}
+	latest, err := latestOffsets(sealed, ends)
+	if err != nil {
+		return nil, err
+	}
+	tmp := path.Join(l.Dir, compactDir)
+	if err = os.RemoveAll(tmp); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(tmp, 0755); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	deleteBefore := time.Now().Add(-l.Config.Compaction.DeleteRetention).UnixNano()
+	var compacted []CompactedSegment
+	for i, s := range sealed {
+		c, ok, err := l.compact(s, ends[i], latest, deleteBefore, tmp)
+		if err != nil {
+			return compacted, err
+		}
+		if ok {
+			compacted = append(compacted, c)
+		}
+	}
+	return compacted, nil
+}
+
+// sealedSegments returns the log's sealed segments, and where each of them ends. We take
+// the ends now: an append that skips ahead can move a sealed segment's end out over the gap.
+func (l *Log) sealedSegments() ([]*segment, []uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed() {
+		return nil, nil, api.ErrLogClosed{}
+	}
+	sealed := make([]*segment, len(l.segments)-1)
+	copy(sealed, l.segments)
+	ends := make([]uint64, len(sealed))
+	for i, s := range sealed {
+		ends[i] = s.nextOffset
+	}
+	return sealed, ends, nil
+}
+
+// latestOffsets reads the sealed segments and returns the latest offset for each key.
+func latestOffsets(sealed []*segment, ends []uint64) (map[string]uint64, error) {
+	latest := make(map[string]uint64)
+	for i, s := range sealed {
+		if err := s.each(ends[i], func(record *api.Record) {
+			if len(record.Key) > 0 {
+				latest[string(record.Key)] = record.Offset
+			}
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return latest, nil
+}
+
+// compact writes a cleaned copy of the segment, up to end, in the tmp directory and swaps
+// it in for the original. We only take the lock to swap the files. compact returns false if
+// the segment had nothing to remove or the log removed the segment in the meantime.
+func (l *Log) compact(
+	s *segment,
+	end uint64,
+	latest map[string]uint64,
+	deleteBefore int64,
+	tmp string,
+) (CompactedSegment, bool, error) {
+	c := CompactedSegment{BaseOffset: s.baseOffset, NextOffset: end}
+	cleaned, err := newSegment(tmp, s.baseOffset, l.Config)
+	if err != nil {
+		return c, false, err
+	}
+	err = s.each(end, func(record *api.Record) {
+		if err != nil {
+			return
+		}
+		if keep(record, latest, deleteBefore) {
+			err = cleaned.write(record)
+			return
+		}
+		c.RecordsRemoved++
+	})
+	c.BytesBefore = s.Size()
+	if cerr := cleaned.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || c.RecordsRemoved == 0 {
+		return c, false, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// the log may have closed, or removed the segment, while we copied it.
+	if l.closed() {
+		return c, false, api.ErrLogClosed{}
+	}
+	i := l.index(s)
+	if i < 0 {
+		return c, false, nil
+	}
+	if err = s.Close(); err != nil {
+		return c, false, err
+	}
+	// we rename the store last: if we crash before then, the index won't match
+	// the original store and the segment rebuilds it when the log starts.
+	for _, ext := range []string{".index", ".timeindex", ".store"} {
+		name := fmt.Sprintf("%d%s", s.baseOffset, ext)
+		if err = os.Rename(path.Join(tmp, name), path.Join(l.Dir, name)); err != nil {
+			return c, false, err
+		}
+	}
+	ns, err := newSegment(l.Dir, s.baseOffset, l.Config)
+	if err != nil {
+		return c, false, err
+	}
+	// the cleaned segment may have lost its last records, but it still ends where the
+	// original did, and keeping its latest timestamp keeps the segments sorted by time.
+	ns.nextOffset = s.nextOffset
+	ns.maxTimestamp = s.maxTimestamp
+	l.segments[i] = ns
+	c.BytesAfter = ns.Size()
+	return c, true, nil
+}
+
+// keep returns whether compaction keeps the record: it has no key, or it's the latest
+// record for its key and not a tombstone older than deleteBefore.
+func keep(record *api.Record, latest map[string]uint64, deleteBefore int64) bool {
+	if len(record.Key) == 0 {
+		return true
+	}
+	if latest[string(record.Key)] != record.Offset {
+		return false
+	}
+	return len(record.Value) > 0 || record.Timestamp >= deleteBefore
+}
+
+// index returns the position of the segment in the log, or -1 if the log doesn't have
+// it anymore. The caller must hold the lock.
+func (l *Log) index(s *segment) int {
+	for i, segment := range l.segments {
+		if segment == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// compactEvery compacts the log every interval until stop is closed, and logs each
+// segment it cleans.
+func (l *Log) compactEvery(interval time.Duration, stop chan struct{}) {
+	logger := zap.L().Named("log")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		compacted, err := l.Compact()
+		for _, c := range compacted {
+			logger.Info(
+				"compacted segment",
+				zap.Uint64("base_offset", c.BaseOffset),
+				zap.Uint64("next_offset", c.NextOffset),
+				zap.Uint64("records_removed", c.RecordsRemoved),
+				zap.Uint64("bytes_before", c.BytesBefore),
+				zap.Uint64("bytes_after", c.BytesAfter),
+			)
+		}
+		if _, ok := err.(api.ErrLogClosed); ok {
+			return
+		}
+		if err != nil {
+			logger.Error("compaction failed", zap.Error(err))
+		}
+	}
+}
+
+// each calls fn with every record in the segment before end, in order, skipping the gaps
+// compaction left.
+func (s *segment) each(end uint64, fn func(record *api.Record)) error {
+	for off := s.baseOffset; off < end; {
+		record, err := s.Read(off)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(record)
+		off = record.Offset + 1
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCompaction defines a table of tests for compaction, each given a fresh log
+// whose segments hold three records each.
+func TestCompaction(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, log *Log,
+	){
+		"keeps the latest record for each key": testCompactionLatest,
+		"survives a restart":                   testCompactionRestart,
+		"removes old tombstones":               testCompactionTombstones,
+		"runs in the background":               testCompactionBackground,
+		"runs alongside appends and retention": testCompactionConcurrent,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "compaction-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 3
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			fn(t, log)
+		})
+	}
+}
+
+// appendKeys appends a record for each key, with the key's value. An empty key
+// appends a record without a key.
+func appendKeys(t *testing.T, log *Log, kvs ...string) {
+	t.Helper()
+	for i := 0; i < len(kvs); i += 2 {
+		record := &api.Record{Value: []byte(kvs[i+1])}
+		if kvs[i] != "" {
+			record.Key = []byte(kvs[i])
+		}
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+}
+
+// appendLatest fills the log with the records testCompactionLatest and
+// testCompactionRestart compact.
+func appendLatest(t *testing.T, log *Log) {
+	appendKeys(t, log,
+		"a", "1", "k", "1", "a", "2", // 0-2
+		"", "x", "b", "1", "a", "3", // 3-5
+		"b", "2", // 6, active
+	)
+	require.Equal(t, 3, len(log.segments))
+}
+
+func testCompactionLatest(t *testing.T, log *Log) {
+	appendLatest(t, log)
+	compacted, err := log.Compact()
+	require.NoError(t, err)
+	// the second segment keeps b's record, since b's latest one is in the active segment.
+	require.Equal(t, 1, len(compacted))
+	require.Equal(t, uint64(0), compacted[0].BaseOffset)
+	require.Equal(t, uint64(3), compacted[0].NextOffset)
+	require.Equal(t, uint64(2), compacted[0].RecordsRemoved)
+	require.Less(t, compacted[0].BytesAfter, compacted[0].BytesBefore)
+
+	requireCompacted(t, log)
+
+	// there's nothing left to remove.
+	compacted, err = log.Compact()
+	require.NoError(t, err)
+	require.Equal(t, 0, len(compacted))
+}
+
+// requireCompacted checks the log has the records appendLatest appended after compaction.
+func requireCompacted(t *testing.T, log *Log) {
+	t.Helper()
+	// reading a removed offset returns the next record, across segments too.
+	for off, want := range map[uint64]uint64{0: 1, 1: 1, 2: 3, 3: 3, 4: 4, 5: 5, 6: 6} {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want, record.Offset)
+	}
+	record, err := log.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), record.Key)
+	require.Equal(t, []byte("3"), record.Value)
+	_, err = log.Read(7)
+	require.Error(t, err)
+}
+
+func testCompactionRestart(t *testing.T, log *Log) {
+	appendLatest(t, log)
+	_, err := log.Compact()
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	requireCompacted(t, n)
+	off, err := n.Append(&api.Record{Value: []byte("y")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+}
+
+func testCompactionTombstones(t *testing.T, log *Log) {
+	appendKeys(t, log,
+		"a", "1", "a", "", "", "x", // 0-2
+		"", "y", // 3, active
+	)
+	log.Config.Compaction.DeleteRetention = time.Hour
+	_, err := log.Compact()
+	require.NoError(t, err)
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), record.Offset)
+	require.Equal(t, 0, len(record.Value))
+
+	// once the tombstone is older than the delete retention, compaction removes it too.
+	log.Config.Compaction.DeleteRetention = time.Nanosecond
+	compacted, err := log.Compact()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(compacted))
+	record, err = log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), record.Offset)
+}
+
+func testCompactionBackground(t *testing.T, log *Log) {
+	appendKeys(t, log, "a", "1", "a", "2", "a", "3", "", "x")
+	log.Config.Compaction.Interval = 10 * time.Millisecond
+	go log.compactEvery(log.Config.Compaction.Interval, log.stop)
+	require.Eventually(t, func() bool {
+		record, err := log.Read(0)
+		return err == nil && record.Offset == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func testCompactionConcurrent(t *testing.T, log *Log) {
+	appendKeys(t, log, "a", "1", "a", "2", "a", "3")
+	// retention removes every segment it can, but keeps the records we read back.
+	log.Config.Retention.MaxBytes = 1
+	log.Config.Retention.MinOffsets = 30
+	errc := make(chan error, 1)
+	go func() {
+		for i := 0; i < 200; i++ {
+			record := &api.Record{Value: []byte("x")}
+			if i%2 == 0 {
+				record.Key = []byte("a")
+			}
+			off, err := log.Append(record)
+			if err == nil {
+				_, err = log.Read(off)
+			}
+			if err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	for i := 0; i < 20; i++ {
+		_, err := log.Compact()
+		require.NoError(t, err)
+		_, err = log.EnforceRetention()
+		require.NoError(t, err)
+	}
+	require.NoError(t, <-errc)
+	next, err := log.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(203), next)
+}
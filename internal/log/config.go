@@ -1,9 +1,87 @@
 package log
 
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// MaxRecordBytes is the biggest record the log accepts. Defaults to 1 MiB.
+		MaxRecordBytes uint64
+		// TimeIndexIntervalBytes is how many bytes a segment writes to its store
+		// between entries in its time index.
+		TimeIndexIntervalBytes uint64
+	}
+	// Durability says when the log flushes appended records to stable storage, and
+	// so how many acknowledged records a power failure can lose.
+	Durability struct {
+		Policy SyncPolicy
+		// Records is how many records the log appends between syncs with SyncEveryN.
+		Records uint64
+		// Interval is how long the log waits between syncs with SyncInterval.
+		Interval time.Duration
+	}
+	// Retention says when the log removes its oldest segments to free up disk space.
+	// The log only ever removes whole segments, and never the active segment.
+	Retention struct {
+		// MaxBytes is how big the log can get on disk before it removes segments.
+		MaxBytes uint64
+		// MaxAge is how long the log keeps a segment after its latest record.
+		MaxAge time.Duration
+		// MinOffsets is how many of the newest offsets the log keeps no matter what.
+		MinOffsets uint64
+		// Interval is how long the log waits between checks.
+		Interval time.Duration
+	}
+	// Compaction says whether the log cleans its sealed segments so they only keep
+	// the latest record for each key. Records without a key are always kept.
+	Compaction struct {
+		Enabled bool
+		// DeleteRetention is how long the log keeps a tombstone (the latest record for
+		// a key, with an empty value) so consumers see the key's deletion. Defaults to a day.
+		DeleteRetention time.Duration
+		// Interval is how long the log waits between compactions.
+		Interval time.Duration
 	}
-}
\ No newline at end of file
+	// Metrics is where the log reports its metrics. Labels tell the series of this log
+	// apart from other logs' in the same registry. Without a registry, the log doesn't report any.
+	Metrics struct {
+		Registry prometheus.Registerer
+		Labels   prometheus.Labels
+	}
+	// Raft configures a DistributedLog: the node's Raft config (its LocalID, at least, and
+	// any timeouts to override), how it talks to the other nodes, and whether it starts a cluster.
+	// A DistributedLog ignores Retention and Compaction, which each node would apply on its own.
+	Raft struct {
+		raft.Config
+		StreamLayer *StreamLayer
+		// Bootstrap makes the node start a new cluster with itself as its only member. Only
+		// the cluster's first node bootstraps, and the leader adds the others with Join.
+		Bootstrap bool
+	}
+}
+
+// SyncPolicy says when the log syncs its store and index files to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves syncing up to the operating system (and to Close). It's
+	// the fastest policy, and a power failure can lose any record the OS hadn't written yet.
+	SyncNever SyncPolicy = iota
+	// SyncEveryAppend syncs before every Append (or AppendBatch) returns, so
+	// an acknowledged record is never lost.
+	SyncEveryAppend
+	// SyncEveryN syncs after every Durability.Records records. Appends don't wait for
+	// the sync, so a power failure can lose up to Durability.Records-1 acknowledged records.
+	SyncEveryN
+	// SyncInterval syncs every Durability.Interval, and appends wait for the next sync
+	// before they return. Appends share syncs, trading latency for throughput, and an
+	// acknowledged record is never lost.
+	SyncInterval
+)
@@ -0,0 +1,582 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/hashicorp/raft"
+)
+
+// DistributedLog is a log replicated across a cluster of nodes with Raft. Every write goes
+// through the cluster's leader, which commits it once a majority of the nodes have it in their
+// Raft log, and then every node appends it to its own Log, the Raft state machine. So once Append
+// returns, the record survives any minority of the nodes failing, and every node's log ends up with
+// the same records under the same offsets. Reads are served from the node's own log, so a follower
+// may be a little behind the leader. Followers reject writes with api.ErrNotLeader, which tells
+// the client where the leader is.
+//
+// The node keeps its data in three places under its data directory: the log itself in log,
+// Raft's log, stored in a Log too, in raft/log, and Raft's term and vote in raft/stable.
+// Raft snapshots the log by copying its stores with Log.Reader, and restores it with Log.Reset.
+type DistributedLog struct {
+	config Config
+	log    *Log
+	raft   *raft.Raft
+
+	raftLog *logStore
+	stable  *stableStore
+}
+
+// applyTimeout is how long Append waits for the cluster to commit a write.
+const applyTimeout = 10 * time.Second
+
+// NewDistributedLog opens the node's logs in dataDir and starts its Raft node. Start a new
+// cluster with a node that has Config.Raft.Bootstrap, and add the other nodes to it with Join.
+func NewDistributedLog(dataDir string, config Config) (*DistributedLog, error) {
+	l := &DistributedLog{config: config}
+	if err := l.setupLog(dataDir); err != nil {
+		return nil, err
+	}
+	if err := l.setupRaft(dataDir); err != nil {
+		l.log.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// setupLog opens the log Raft applies writes to. Raft rebuilds it from its latest snapshot and
+// its own log whenever the node starts, applying every write since the snapshot again, so we
+// start the log over rather than end up with those records twice.
+//
+// The log doesn't remove or compact records on its own: every node would do so on its own
+// clock, so their logs would stop matching, and a snapshot reads stores that retention and
+// compaction would close or replace while Raft persists it.
+func (l *DistributedLog) setupLog(dataDir string) error {
+	dir := filepath.Join(dataDir, "log")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	logConfig := l.config
+	logConfig.Retention.MaxBytes = 0
+	logConfig.Retention.MaxAge = 0
+	logConfig.Compaction.Enabled = false
+	var err error
+	if l.log, err = NewLog(dir, logConfig); err != nil {
+		return err
+	}
+	return l.log.Reset()
+}
+
+// setupRaft starts the node's Raft node, with a Log for Raft's log, and bootstraps the cluster
+// if the config says so and the node doesn't have any Raft state yet.
+func (l *DistributedLog) setupRaft(dataDir string) error {
+	dir := filepath.Join(dataDir, "raft", "log")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// Raft's indexes start at 1, Raft needs its log on disk before it acknowledges an entry,
+	// and the log's metrics are the state machine's.
+	logConfig := l.config
+	logConfig.Segment.InitialOffset = 1
+	logConfig.Durability.Policy = SyncEveryAppend
+	logConfig.Retention.MaxBytes = 0
+	logConfig.Retention.MaxAge = 0
+	logConfig.Compaction.Enabled = false
+	logConfig.Metrics.Registry = nil
+	var err error
+	if l.raftLog, err = newLogStore(dir, logConfig); err != nil {
+		return err
+	}
+	if l.stable, err = newStableStore(filepath.Join(dataDir, "raft", "stable")); err != nil {
+		l.raftLog.Close()
+		return err
+	}
+	logOutput := l.config.Raft.LogOutput
+	if logOutput == nil {
+		logOutput = os.Stderr
+	}
+	// we keep the latest snapshot, which is all Raft needs to catch up a node.
+	snapshots, err := raft.NewFileSnapshotStore(filepath.Join(dataDir, "raft"), 1, logOutput)
+	if err != nil {
+		l.closeStores()
+		return err
+	}
+	transport := raft.NewNetworkTransport(l.config.Raft.StreamLayer, 5, 10*time.Second, logOutput)
+
+	config := raft.DefaultConfig()
+	config.LocalID = l.config.Raft.LocalID
+	config.LogOutput = logOutput
+	config.LogLevel = "INFO"
+	if l.config.Raft.LogLevel != "" {
+		config.LogLevel = l.config.Raft.LogLevel
+	}
+	if l.config.Raft.HeartbeatTimeout != 0 {
+		config.HeartbeatTimeout = l.config.Raft.HeartbeatTimeout
+	}
+	if l.config.Raft.ElectionTimeout != 0 {
+		config.ElectionTimeout = l.config.Raft.ElectionTimeout
+	}
+	if l.config.Raft.LeaderLeaseTimeout != 0 {
+		config.LeaderLeaseTimeout = l.config.Raft.LeaderLeaseTimeout
+	}
+	if l.config.Raft.CommitTimeout != 0 {
+		config.CommitTimeout = l.config.Raft.CommitTimeout
+	}
+	if l.config.Raft.SnapshotInterval != 0 {
+		config.SnapshotInterval = l.config.Raft.SnapshotInterval
+	}
+	if l.config.Raft.SnapshotThreshold != 0 {
+		config.SnapshotThreshold = l.config.Raft.SnapshotThreshold
+	}
+	if l.config.Raft.TrailingLogs != 0 {
+		config.TrailingLogs = l.config.Raft.TrailingLogs
+	}
+
+	hasState, err := raft.HasExistingState(l.raftLog, l.stable, snapshots)
+	if err != nil {
+		l.closeStores()
+		return err
+	}
+	l.raft, err = raft.NewRaft(config, &fsm{log: l.log}, l.raftLog, l.stable, snapshots, transport)
+	if err != nil {
+		transport.Close()
+		l.closeStores()
+		return err
+	}
+	if l.config.Raft.Bootstrap && !hasState {
+		err = l.raft.BootstrapCluster(raft.Configuration{
+			Servers: []raft.Server{{
+				ID:      config.LocalID,
+				Address: transport.LocalAddr(),
+			}},
+		}).Error()
+	}
+	return err
+}
+
+// Append replicates the record to the cluster and returns its offset once the cluster commits
+// it and the node appends it to its own log. The leader stamps the record, if the producer
+// didn't, so every node's copy has the same timestamp.
+func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano()
+	}
+	res, err := l.apply(appendRequestType, &api.ProduceRequest{Record: record})
+	if err != nil {
+		return 0, err
+	}
+	record.Offset = res.(*api.ProduceResponse).Offset
+	return record.Offset, nil
+}
+
+// AppendBatch replicates the records as one Raft entry, so they're all or nothing across
+// the cluster too, and returns their offsets.
+func (l *DistributedLog) AppendBatch(records []*api.Record) ([]uint64, error) {
+	now := time.Now().UnixNano()
+	for _, record := range records {
+		if record.Timestamp == 0 {
+			record.Timestamp = now
+		}
+	}
+	res, err := l.apply(appendBatchRequestType, &api.ProduceBatchRequest{Records: records})
+	if err != nil {
+		return nil, err
+	}
+	offsets := res.(*api.ProduceBatchResponse).Offsets
+	for i, record := range records {
+		record.Offset = offsets[i]
+	}
+	return offsets, nil
+}
+
+// apply commits the request to the cluster and returns what the state machine made of it.
+func (l *DistributedLog) apply(reqType requestType, req proto.Message) (interface{}, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(reqType))
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(b)
+	future := l.raft.Apply(buf.Bytes(), applyTimeout)
+	if err = future.Error(); err != nil {
+		return nil, l.raftErr(err)
+	}
+	res := future.Response()
+	if err, ok := res.(error); ok {
+		return nil, err
+	}
+	return res, nil
+}
+
+// raftErr turns raft.ErrNotLeader into an api.ErrNotLeader, with the leader's address.
+func (l *DistributedLog) raftErr(err error) error {
+	if err == raft.ErrNotLeader {
+		return api.ErrNotLeader{Leader: string(l.raft.Leader())}
+	}
+	return err
+}
+
+// Read reads the record at the offset from the node's own log.
+func (l *DistributedLog) Read(off uint64) (*api.Record, error) {
+	return l.log.Read(off)
+}
+
+// OffsetForTime returns the offset of the first record at or after t in the node's own log.
+func (l *DistributedLog) OffsetForTime(t time.Time) (uint64, error) {
+	return l.log.OffsetForTime(t)
+}
+
+// Wait waits until the node's own log has the offset.
+func (l *DistributedLog) Wait(ctx context.Context, off uint64) error {
+	return l.log.Wait(ctx, off)
+}
+
+// NewIterator returns an iterator over the node's own log.
+func (l *DistributedLog) NewIterator(off uint64) *Iterator {
+	return l.log.NewIterator(off)
+}
+
+// LowestOffset returns the lowest offset in the node's own log.
+func (l *DistributedLog) LowestOffset() (uint64, error) {
+	return l.log.LowestOffset()
+}
+
+// NextOffset returns the offset the node's own log gives its next record.
+func (l *DistributedLog) NextOffset() (uint64, error) {
+	return l.log.NextOffset()
+}
+
+// Writable returns api.ErrLogClosed once the log is closed. Followers take writes as far
+// as health checks go, they just hand them to the leader's clients with api.ErrNotLeader.
+func (l *DistributedLog) Writable() error {
+	return l.log.Writable()
+}
+
+// Join adds the node with the ID and Raft address to the cluster as a voter. Only the
+// leader can add nodes, the others return api.ErrNotLeader. A node that's already in the
+// cluster under the same ID and address stays as it is, and one that changed either is
+// removed and added again.
+func (l *DistributedLog) Join(id, addr string) error {
+	configFuture := l.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	serverID := raft.ServerID(id)
+	serverAddr := raft.ServerAddress(addr)
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID != serverID && srv.Address != serverAddr {
+			continue
+		}
+		if srv.ID == serverID && srv.Address == serverAddr {
+			return nil
+		}
+		if err := l.raft.RemoveServer(srv.ID, 0, 0).Error(); err != nil {
+			return l.raftErr(err)
+		}
+	}
+	return l.raftErr(l.raft.AddVoter(serverID, serverAddr, 0, 0).Error())
+}
+
+// Leave removes the node with the ID from the cluster. Only the leader can remove nodes.
+func (l *DistributedLog) Leave(id string) error {
+	return l.raftErr(l.raft.RemoveServer(raft.ServerID(id), 0, 0).Error())
+}
+
+// WaitForLeader waits until the cluster has a leader, or returns an error after the timeout.
+func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
+	timeoutc := time.After(timeout)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timeoutc:
+			return fmt.Errorf("timed out waiting for a leader after %s", timeout)
+		case <-ticker.C:
+			if l.raft.Leader() != "" {
+				return nil
+			}
+		}
+	}
+}
+
+// Close shuts down the node's Raft node, which closes its transport, and closes its logs.
+func (l *DistributedLog) Close() error {
+	if err := l.raft.Shutdown().Error(); err != nil {
+		return err
+	}
+	if err := l.closeStores(); err != nil {
+		return err
+	}
+	return l.log.Close()
+}
+
+// closeStores closes Raft's log. The stable store doesn't keep its file open.
+func (l *DistributedLog) closeStores() error {
+	return l.raftLog.Close()
+}
+
+// requestType says what a Raft entry asks the state machine to do, in its first byte.
+type requestType uint8
+
+const (
+	appendRequestType requestType = iota
+	appendBatchRequestType
+)
+
+var _ raft.FSM = (*fsm)(nil)
+
+// fsm is the Raft state machine: the node's log, which it appends the committed writes to.
+type fsm struct {
+	log *Log
+}
+
+// Apply applies a committed entry to the log, and returns what the entry's request returns,
+// an error included.
+func (f *fsm) Apply(record *raft.Log) interface{} {
+	buf := record.Data
+	if len(buf) == 0 {
+		return nil
+	}
+	switch requestType(buf[0]) {
+	case appendRequestType:
+		return f.applyAppend(buf[1:])
+	case appendBatchRequestType:
+		return f.applyAppendBatch(buf[1:])
+	}
+	return fmt.Errorf("unknown request type: %d", buf[0])
+}
+
+func (f *fsm) applyAppend(b []byte) interface{} {
+	var req api.ProduceRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	offset, err := f.log.Append(req.Record)
+	if err != nil {
+		return err
+	}
+	return &api.ProduceResponse{Offset: offset}
+}
+
+func (f *fsm) applyAppendBatch(b []byte) interface{} {
+	var req api.ProduceBatchRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	offsets, err := f.log.AppendBatch(req.Records)
+	if err != nil {
+		return err
+	}
+	return &api.ProduceBatchResponse{Offsets: offsets}
+}
+
+// Snapshot returns a snapshot of the log: its stores, as they are now.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	return &snapshot{reader: f.log.Reader()}, nil
+}
+
+// Restore replaces the log with the one in the snapshot, keeping the records' offsets.
+func (f *fsm) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	if err := f.log.Reset(); err != nil {
+		return err
+	}
+	for {
+		b, err := readFrame(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		record := &api.Record{}
+		if err = proto.Unmarshal(b, record); err != nil {
+			return err
+		}
+		if err = f.log.AppendAt(record); err != nil {
+			return err
+		}
+	}
+}
+
+var _ raft.FSMSnapshot = (*snapshot)(nil)
+
+type snapshot struct {
+	reader io.Reader
+}
+
+// Persist writes the log's stores to the sink Raft gives us, a file in the snapshot store.
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := io.Copy(sink, s.reader); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {}
+
+var _ raft.LogStore = (*logStore)(nil)
+
+// logStore is Raft's log, stored in a Log: each Raft entry is a record under the entry's
+// index, with the entry's data as its value.
+type logStore struct {
+	*Log
+}
+
+func newLogStore(dir string, c Config) (*logStore, error) {
+	l, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	return &logStore{l}, nil
+}
+
+// FirstIndex returns the index of the first entry in the log.
+func (l *logStore) FirstIndex() (uint64, error) {
+	return l.LowestOffset()
+}
+
+// LastIndex returns the index of the last entry in the log, or 0 if the log never had one.
+func (l *logStore) LastIndex() (uint64, error) {
+	next, err := l.NextOffset()
+	if err != nil {
+		return 0, err
+	}
+	return next - 1, nil
+}
+
+// GetLog reads the entry at the index into out, or returns raft.ErrLogNotFound.
+func (l *logStore) GetLog(index uint64, out *raft.Log) error {
+	record, err := l.Read(index)
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+		return raft.ErrLogNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if record.Offset != index {
+		return raft.ErrLogNotFound
+	}
+	out.Index = record.Offset
+	out.Term = record.Term
+	out.Type = raft.LogType(record.Type)
+	out.Data = record.Value
+	return nil
+}
+
+// StoreLog appends the entry to the log.
+func (l *logStore) StoreLog(record *raft.Log) error {
+	return l.StoreLogs([]*raft.Log{record})
+}
+
+// StoreLogs appends the entries to the log, under their indexes.
+func (l *logStore) StoreLogs(records []*raft.Log) error {
+	for _, record := range records {
+		if err := l.AppendAt(&api.Record{
+			Value:  record.Data,
+			Offset: record.Index,
+			Term:   record.Term,
+			Type:   uint32(record.Type),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteRange removes the entries from min to max. Raft either removes the oldest entries,
+// which it has in a snapshot, or the newest, which conflict with the leader's.
+func (l *logStore) DeleteRange(min, max uint64) error {
+	first, err := l.FirstIndex()
+	if err != nil {
+		return err
+	}
+	if min <= first {
+		return l.Truncate(max)
+	}
+	return l.Rewind(min)
+}
+
+// raftRPC is the first byte of every connection between Raft nodes, so a listener shared
+// with other protocols can tell Raft's connections apart.
+const raftRPC = 1
+
+var _ raft.StreamLayer = (*StreamLayer)(nil)
+
+// StreamLayer is how Raft nodes connect to each other, over a listener we give it. With
+// TLS configs, the node accepts connections with serverTLSConfig and connects to the other
+// nodes with peerTLSConfig.
+type StreamLayer struct {
+	ln              net.Listener
+	serverTLSConfig *tls.Config
+	peerTLSConfig   *tls.Config
+}
+
+// NewStreamLayer returns a stream layer that accepts connections from the listener.
+// The TLS configs may be nil.
+func NewStreamLayer(ln net.Listener, serverTLSConfig, peerTLSConfig *tls.Config) *StreamLayer {
+	return &StreamLayer{
+		ln:              ln,
+		serverTLSConfig: serverTLSConfig,
+		peerTLSConfig:   peerTLSConfig,
+	}
+}
+
+// Dial connects to the Raft node at the address.
+func (s *StreamLayer) Dial(addr raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.Dial("tcp", string(addr))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write([]byte{byte(raftRPC)}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if s.peerTLSConfig != nil {
+		conn = tls.Client(conn, s.peerTLSConfig)
+	}
+	return conn, nil
+}
+
+// Accept accepts the next connection from another Raft node.
+func (s *StreamLayer) Accept() (net.Conn, error) {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 1)
+	if _, err = conn.Read(b); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if b[0] != byte(raftRPC) {
+		conn.Close()
+		return nil, fmt.Errorf("not a raft rpc")
+	}
+	if s.serverTLSConfig != nil {
+		return tls.Server(conn, s.serverTLSConfig), nil
+	}
+	return conn, nil
+}
+
+// Close closes the listener.
+func (s *StreamLayer) Close() error {
+	return s.ln.Close()
+}
+
+// Addr returns the listener's address, which is the node's Raft address.
+func (s *StreamLayer) Addr() net.Addr {
+	return s.ln.Addr()
+}
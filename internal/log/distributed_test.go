@@ -0,0 +1,143 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMultipleNodes tests a cluster of three nodes over loopback: the leader replicates
+// records to the followers, the followers reject writes, a node that leaves stops getting
+// records, and a node that joins after the leader snapshotted, or restarts, catches up.
+func TestMultipleNodes(t *testing.T) {
+	var logs []*DistributedLog
+	var dirs, addrs []string
+	defer func() {
+		for _, l := range logs {
+			l.Close()
+		}
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}()
+	// newNode starts the ith node, listening on addr, or on a new port without one.
+	newNode := func(i int, dir, addr string) *DistributedLog {
+		if addr == "" {
+			addr = "127.0.0.1:0"
+		}
+		ln, err := net.Listen("tcp", addr)
+		require.NoError(t, err)
+		c := Config{}
+		// small segments, so Raft's log gets rid of the entries it snapshotted.
+		c.Segment.MaxStoreBytes = 64
+		// retention and compaction would remove records on each node on its own, so the
+		// distributed log turns them off, and every record below stays where it is.
+		c.Retention.MaxBytes = 1
+		c.Retention.Interval = time.Millisecond
+		c.Compaction.Enabled = true
+		c.Compaction.Interval = time.Millisecond
+		c.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		c.Raft.LocalID = raft.ServerID(fmt.Sprint(i))
+		c.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		c.Raft.ElectionTimeout = 50 * time.Millisecond
+		c.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		c.Raft.CommitTimeout = 5 * time.Millisecond
+		c.Raft.SnapshotInterval = 20 * time.Millisecond
+		c.Raft.SnapshotThreshold = 4
+		c.Raft.TrailingLogs = 1
+		c.Raft.LogLevel = "ERROR"
+		c.Raft.Bootstrap = i == 0
+		l, err := NewDistributedLog(dir, c)
+		require.NoError(t, err)
+		return l
+	}
+	for i := 0; i < 3; i++ {
+		dir, err := ioutil.TempDir("", "distributed-log-test")
+		require.NoError(t, err)
+		dirs = append(dirs, dir)
+		l := newNode(i, dir, "")
+		addrs = append(addrs, l.config.Raft.StreamLayer.Addr().String())
+		if i == 0 {
+			require.NoError(t, l.WaitForLeader(3*time.Second))
+		} else {
+			require.NoError(t, logs[0].Join(fmt.Sprint(i), addrs[i]))
+		}
+		logs = append(logs, l)
+	}
+
+	// hasRecords returns whether the node's log has the values, from offset 0.
+	hasRecords := func(l *DistributedLog, values ...string) func() bool {
+		return func() bool {
+			next, err := l.NextOffset()
+			require.NoError(t, err)
+			if next != uint64(len(values)) {
+				return false
+			}
+			for off, value := range values {
+				record, err := l.Read(uint64(off))
+				if err != nil || string(record.Value) != value {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	want := []string{"first", "second"}
+	for i, value := range want {
+		off, err := logs[0].Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	offsets, err := logs[0].AppendBatch([]*api.Record{
+		{Value: []byte("third")},
+		{Value: []byte("fourth")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 3}, offsets)
+	want = append(want, "third", "fourth")
+	for _, l := range logs {
+		require.Eventually(t, hasRecords(l, want...), 3*time.Second, 10*time.Millisecond)
+	}
+	// every node's copy of a record is the same, down to its timestamp.
+	leaderRecord, err := logs[0].Read(0)
+	require.NoError(t, err)
+	followerRecord, err := logs[1].Read(0)
+	require.NoError(t, err)
+	require.Equal(t, leaderRecord.Timestamp, followerRecord.Timestamp)
+
+	_, err = logs[1].Append(&api.Record{Value: []byte("fifth")})
+	require.Equal(t, api.ErrNotLeader{Leader: addrs[0]}, err)
+
+	// a node that left doesn't get new records.
+	require.NoError(t, logs[0].Leave("1"))
+	_, err = logs[0].Append(&api.Record{Value: []byte("fifth")})
+	require.NoError(t, err)
+	require.Eventually(t, hasRecords(logs[2], append(want, "fifth")...), 3*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	require.True(t, hasRecords(logs[1], want...)())
+	want = append(want, "fifth")
+
+	// a node that joins after the leader snapshotted gets the records from the snapshot,
+	// and a node that restarts gets what it missed.
+	dir, err := ioutil.TempDir("", "distributed-log-test")
+	require.NoError(t, err)
+	dirs = append(dirs, dir)
+	l := newNode(3, dir, "")
+	logs = append(logs, l)
+	require.NoError(t, logs[0].Join("3", l.config.Raft.StreamLayer.Addr().String()))
+	require.Eventually(t, hasRecords(l, want...), 3*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, logs[2].Close())
+	_, err = logs[0].Append(&api.Record{Value: []byte("sixth")})
+	require.NoError(t, err)
+	want = append(want, "sixth")
+	logs[2] = newNode(2, dirs[2], addrs[2])
+	require.Eventually(t, hasRecords(logs[2], want...), 3*time.Second, 10*time.Millisecond)
+}
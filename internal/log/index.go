@@ -3,6 +3,7 @@ package log
 import (
 	"io"
 	"os"
+	"sort"
 
 	"github.com/tysonmote/gommap"
 )
@@ -19,6 +20,8 @@ type index struct {
 	file *os.File
 	mmap gommap.MMap
 	size uint64
+	// syncs counts the index's syncs, so tests can check the durability policies.
+	syncs uint64
 }
 
 // How it works ?
@@ -89,6 +92,21 @@ func(i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	return out, pos, nil
 }
 
+// Search returns the number of the first entry whose relative offset is at or after off,
+// which you can pass to Read. Compaction removes records from a segment, so the entry for
+// an offset isn't always at the offset itself, and the entries' offsets have gaps. The offsets
+// are still sorted, so we binary search them, after checking where the entry would be without gaps.
+// If every entry is before off, Search returns the number of entries and Read returns io.EOF.
+func(i *index) Search(off uint32) int64 {
+	n := i.size / entWidth
+	if uint64(off) < n && enc.Uint32(i.mmap[uint64(off)*entWidth:]) == off {
+		return int64(off)
+	}
+	return int64(sort.Search(int(n), func(e int) bool {
+		return enc.Uint32(i.mmap[uint64(e)*entWidth:]) >= off
+	}))
+}
+
 // Write appends the given offset and position to the index.
 func(i *index) Write(off uint32, pos uint64) error {
 	// validate that we have space to write the entry
@@ -102,13 +120,20 @@ func(i *index) Write(off uint32, pos uint64) error {
 	return nil
 }
 
-// Close makes sure the memory-mapped file has synced its data to the persisted file
-// and that persisted file has flushed its contents to stable storage.
-func (i *index) Close() error {
-	if err := i.mmap.Sync(gommap.MS_ASYNC); err != nil {
+// Sync makes sure the memory-mapped file has synced its data to the persisted file
+// and that persisted file has flushed its contents to stable storage. We use MS_SYNC
+// so msync doesn't return until the pages are written, MS_ASYNC only schedules the write.
+func (i *index) Sync() error {
+	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
 		return err
 	}
-	if err := i.file.Sync(); err != nil {
+	i.syncs++
+	return i.file.Sync()
+}
+
+// Close syncs the index and truncates the file to the size of its entries.
+func (i *index) Close() error {
+	if err := i.Sync(); err != nil {
 		return err
 	}
 	if err := i.file.Truncate(int64(i.size)); err != nil {
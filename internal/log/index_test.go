@@ -56,4 +56,34 @@ func TestIndex(t *testing.T){
 	require.NoError(t, err)
 	require.Equal(t, uint32(1), off)
 	require.Equal(t, entries[1].Pos, pos)
-}
\ No newline at end of file
+}
+
+func TestIndexSearch(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_search_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	defer idx.Close()
+
+	// compaction leaves gaps between the offsets.
+	for i, off := range []uint32{0, 3, 4, 8} {
+		require.NoError(t, idx.Write(off, uint64(i)*10))
+	}
+	for off, want := range map[uint32]int64{
+		0: 0,
+		1: 1,
+		3: 1,
+		4: 2,
+		5: 3,
+		8: 3,
+		9: 4,
+	} {
+		require.Equal(t, want, idx.Search(off))
+	}
+	_, _, err = idx.Read(idx.Search(9))
+	require.Equal(t, io.EOF, err)
+}
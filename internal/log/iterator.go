@@ -0,0 +1,248 @@
+package log
+
+import (
+	"github.com/golang/protobuf/proto"
+	api "github.com/hafizmfadli/proglog/api/v1"
+)
+
+// iteratorBufferBytes is how much of the store an iterator reads at once.
+const iteratorBufferBytes = 64 * 1024
+
+// Iterator reads the log's records in order. Rather than look up every record in a segment's
+// index like Read does, the iterator finds its starting point once and then reads each segment's
+// store front to back, a buffer at a time, moving on to the next segment when it reaches the end of one.
+//
+// The iterator keeps working while the log changes under it: when the log rolls over to a new
+// segment the iterator follows it, retention removing segments behind the iterator doesn't affect
+// it, and when compaction replaces the segment it's reading, it finds its place again in the new one.
+//
+//	it := log.NewIterator(0)
+//	defer it.Close()
+//	for it.Next() {
+//		record := it.Record()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator struct {
+	log *Log
+	// off is the offset of the next record we want.
+	off uint64
+
+	// seg is the segment we're reading, i is where it was in the log's segments
+	// the last time we looked, and pos is where the next record's frame starts in its store.
+	seg *segment
+	i   int
+	pos uint64
+
+	// buf holds the store's bytes from position bufPos onwards.
+	buf    []byte
+	bufPos uint64
+
+	record *api.Record
+	err    error
+	closed bool
+}
+
+// NewIterator returns an iterator that starts at the given offset. If compaction removed
+// the record at that offset, the iterator starts at the next record.
+func (l *Log) NewIterator(from uint64) *Iterator {
+	return &Iterator{
+		log: l,
+		off: from,
+	}
+}
+
+// Next moves the iterator to the next record, which you get with Record. Next returns false
+// when the iterator fails, which Err tells you about, or when it reaches the end of the log. The
+// iterator stays where it is at the end of the log, so once the log appends more records (Log.Wait
+// tells you when), you can call Next again to carry on.
+func (it *Iterator) Next() bool {
+	if it.closed || it.err != nil {
+		return false
+	}
+	l := it.log
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed() {
+		it.err = api.ErrLogClosed{}
+		return false
+	}
+	if !it.located() {
+		if ok := it.locate(); !ok {
+			return false
+		}
+	}
+	for it.pos >= it.seg.store.size {
+		// we're at the end of the active segment, so we're at the end of the log.
+		if it.seg == l.activeSegment {
+			return false
+		}
+		it.i++
+		it.seg = l.segments[it.i]
+		it.pos = 0
+		it.buf = it.buf[:0]
+	}
+	p, width, err := it.frame()
+	if err != nil {
+		it.err = it.corrupt(err)
+		return false
+	}
+	record := &api.Record{}
+	if proto.Unmarshal(p, record) != nil {
+		it.err = it.corrupt(errChecksum)
+		return false
+	}
+	it.record = record
+	it.off = record.Offset + 1
+	it.pos += width
+	return true
+}
+
+// located returns whether the segment the iterator is reading is still where it was in the
+// log. If retention removed segments before it, we find it again further up the log.
+// The caller must hold the log's lock.
+func (it *Iterator) located() bool {
+	if it.seg == nil {
+		return false
+	}
+	segments := it.log.segments
+	if it.i < len(segments) && segments[it.i] == it.seg {
+		return true
+	}
+	for i, s := range segments {
+		if s == it.seg {
+			it.i = i
+			return true
+		}
+	}
+	return false
+}
+
+// locate finds the segment with the iterator's next offset and the position of the record
+// in its store, when the iterator starts or when compaction replaced the segment it was reading.
+// It returns false when the log no longer has the offset, or doesn't have it yet.
+// The caller must hold the log's lock.
+func (it *Iterator) locate() bool {
+	segments := it.log.segments
+	if it.off < segments[0].baseOffset {
+		it.err = api.ErrOffsetOutOfRange{Offset: it.off}
+		return false
+	}
+	if it.off >= it.log.activeSegment.nextOffset {
+		return false
+	}
+	for i, s := range segments {
+		if it.off >= s.nextOffset {
+			continue
+		}
+		off := it.off
+		if off < s.baseOffset {
+			off = s.baseOffset
+		}
+		it.seg, it.i, it.buf = s, i, it.buf[:0]
+		// past the index's last entry means the segment has nothing left for us, so
+		// we start at the end of its store and move on from there.
+		it.pos = s.store.size
+		if _, pos, err := s.index.Read(s.index.Search(uint32(off - s.baseOffset))); err == nil {
+			it.pos = pos
+		}
+		return true
+	}
+	return false
+}
+
+// frame returns the data of the record whose frame starts at the iterator's position, along with
+// the width of the frame. It reads the same framing as the store.
+func (it *Iterator) frame() ([]byte, uint64, error) {
+	b, err := it.fill(lenWidth)
+	if err != nil {
+		return nil, 0, err
+	}
+	size := b[:lenWidth]
+	n := enc.Uint64(size)
+	if n&crcFlag == 0 {
+		// the record was written before we added checksums.
+		if b, err = it.fill(lenWidth + n); err != nil {
+			return nil, 0, err
+		}
+		return b[lenWidth:], lenWidth + n, nil
+	}
+	n &^= crcFlag
+	width := lenWidth + crcWidth + n
+	if b, err = it.fill(width); err != nil {
+		return nil, 0, err
+	}
+	p := b[lenWidth+crcWidth:]
+	if checksum(size, p) != enc.Uint32(b[lenWidth:lenWidth+crcWidth]) {
+		return nil, 0, errChecksum
+	}
+	return p, width, nil
+}
+
+// fill returns the n bytes of the store at the iterator's position, reading more of the store
+// into the buffer if it doesn't have them yet.
+func (it *Iterator) fill(n uint64) ([]byte, error) {
+	s := it.seg.store
+	if it.pos+n > s.size {
+		return nil, errChecksum
+	}
+	if it.pos < it.bufPos || it.pos+n > it.bufPos+uint64(len(it.buf)) {
+		size := n
+		if size < iteratorBufferBytes {
+			size = iteratorBufferBytes
+		}
+		if it.pos+size > s.size {
+			size = s.size - it.pos
+		}
+		if uint64(cap(it.buf)) < size {
+			it.buf = make([]byte, size)
+		}
+		it.buf = it.buf[:size]
+		if _, err := s.ReadAt(it.buf, int64(it.pos)); err != nil {
+			it.buf = it.buf[:0]
+			return nil, err
+		}
+		it.bufPos = it.pos
+	}
+	start := it.pos - it.bufPos
+	return it.buf[start : start+n], nil
+}
+
+// corrupt turns a checksum error (or a record that doesn't unmarshal) into an api.ErrCorruptRecord that says where the damage is.
+func (it *Iterator) corrupt(err error) error {
+	if err != errChecksum {
+		return err
+	}
+	return api.ErrCorruptRecord{
+		Offset:     it.off,
+		BaseOffset: it.seg.baseOffset,
+		Position:   it.pos,
+	}
+}
+
+// Record returns the record Next moved to.
+func (it *Iterator) Record() *api.Record {
+	return it.record
+}
+
+// Offset returns the offset the iterator looks for next, which is where it carries on
+// after reaching the end of the log.
+func (it *Iterator) Offset() uint64 {
+	return it.off
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator's buffer. The iterator doesn't return any more records after you close it.
+func (it *Iterator) Close() error {
+	it.closed = true
+	it.seg = nil
+	it.buf = nil
+	it.record = nil
+	return nil
+}
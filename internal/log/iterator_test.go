@@ -0,0 +1,144 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// TestIterator defines a table of tests for the iterator, each given a fresh log
+// whose segments hold three records each.
+func TestIterator(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, log *Log,
+	){
+		"reads every record across segments": testIteratorRead,
+		"carries on after appends":           testIteratorAppend,
+		"skips compacted records":            testIteratorCompaction,
+		"survives retention behind it":       testIteratorRetention,
+		"fails on a removed offset":          testIteratorOutOfRange,
+		"fails on a corrupt record":          testIteratorCorrupt,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "iterator-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 3
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			fn(t, log)
+		})
+	}
+}
+
+// requireNext moves the iterator to the next record and checks its offset.
+func requireNext(t *testing.T, it *Iterator, off uint64) {
+	t.Helper()
+	require.True(t, it.Next(), "next: %v", it.Err())
+	require.Equal(t, off, it.Record().Offset)
+}
+
+func testIteratorRead(t *testing.T, log *Log) {
+	appendN(t, log, 8, 0)
+	it := log.NewIterator(2)
+	defer it.Close()
+	for off := uint64(2); off < 8; off++ {
+		requireNext(t, it, off)
+		require.Equal(t, []byte("hello world"), it.Record().Value)
+	}
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+	require.Equal(t, uint64(8), it.Offset())
+}
+
+func testIteratorAppend(t *testing.T, log *Log) {
+	// an iterator that starts past the end of the log waits for its offset.
+	it := log.NewIterator(1)
+	defer it.Close()
+	require.False(t, it.Next())
+	appendN(t, log, 1, 0)
+	require.False(t, it.Next())
+	// the log rolls over to a new segment as we go.
+	for off := uint64(1); off < 5; off++ {
+		appendN(t, log, 1, 0)
+		requireNext(t, it, off)
+		require.False(t, it.Next())
+	}
+	require.NoError(t, it.Err())
+}
+
+func testIteratorCompaction(t *testing.T, log *Log) {
+	appendLatest(t, log)
+	it := log.NewIterator(0)
+	defer it.Close()
+	requireNext(t, it, 0)
+
+	_, err := log.Compact()
+	require.NoError(t, err)
+	// the iterator finds its place in the compacted segment.
+	for _, off := range []uint64{1, 3, 4, 5, 6} {
+		requireNext(t, it, off)
+	}
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+
+	it = log.NewIterator(2)
+	defer it.Close()
+	requireNext(t, it, 3)
+}
+
+func testIteratorRetention(t *testing.T, log *Log) {
+	appendN(t, log, 7, 0)
+	it := log.NewIterator(0)
+	defer it.Close()
+	for off := uint64(0); off < 4; off++ {
+		requireNext(t, it, off)
+	}
+	// remove the first segment, which the iterator has read.
+	log.Config.Retention.MaxBytes = log.segments[1].Size() + log.segments[2].Size()
+	removed, err := log.EnforceRetention()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(removed))
+	for off := uint64(4); off < 7; off++ {
+		requireNext(t, it, off)
+	}
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+}
+
+func testIteratorOutOfRange(t *testing.T, log *Log) {
+	appendN(t, log, 4, 0)
+	require.NoError(t, log.Truncate(2))
+	it := log.NewIterator(0)
+	defer it.Close()
+	require.False(t, it.Next())
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, it.Err())
+}
+
+func testIteratorCorrupt(t *testing.T, log *Log) {
+	appendN(t, log, 2, 0)
+	s := log.segments[0]
+	_, pos, err := s.index.Read(1)
+	require.NoError(t, err)
+	require.NoError(t, s.store.buf.Flush())
+	f, err := os.OpenFile(s.store.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("x"), int64(pos+lenWidth+crcWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	it := log.NewIterator(0)
+	defer it.Close()
+	requireNext(t, it, 0)
+	require.False(t, it.Next())
+	require.Equal(t, api.ErrCorruptRecord{
+		Offset:     1,
+		BaseOffset: 0,
+		Position:   pos,
+	}, it.Err())
+}
@@ -1,16 +1,20 @@
 package log
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	api "github.com/hafizmfadli/proglog/api/v1"
+	"go.uber.org/zap"
 )
 
 // Log consists of a list of segments and a pointer to the active segment to
@@ -21,6 +25,35 @@ type Log struct {
 	Config Config
 	activeSegment *segment
 	segments []*segment
+
+	// unsynced counts the records appended since the last sync, synced is what appends
+	// wait on for the next sync with SyncInterval, and stop stops the log's background goroutines.
+	unsynced uint64
+	synced *syncWaiter
+	stop chan struct{}
+
+	// compacting makes sure only one compaction runs at a time. Compaction reads sealed
+	// segments without mu, so everything that closes segments takes compacting first, then mu.
+	compacting sync.Mutex
+
+	// appended is closed (and replaced) whenever the log appends records, which wakes up
+	// everyone waiting for new records.
+	appended chan struct{}
+
+	// readOnly makes appends fail with ErrReadOnly.
+	readOnly bool
+
+	metrics *logMetrics
+}
+
+// syncWaiter is closed once the log syncs, and holds the sync's error for the appends waiting on it.
+type syncWaiter struct {
+	done chan struct{}
+	err error
+}
+
+func newSyncWaiter() *syncWaiter {
+	return &syncWaiter{done: make(chan struct{})}
 }
 
 // NewLog set defaults for the configs the caller didn't specify, create a log 
@@ -32,6 +65,27 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	if c.Segment.MaxRecordBytes == 0 {
+		c.Segment.MaxRecordBytes = 1 << 20
+	}
+	if c.Segment.TimeIndexIntervalBytes == 0 {
+		c.Segment.TimeIndexIntervalBytes = 4096
+	}
+	if c.Durability.Records == 0 {
+		c.Durability.Records = 1
+	}
+	if c.Durability.Interval == 0 {
+		c.Durability.Interval = 10 * time.Millisecond
+	}
+	if c.Retention.Interval == 0 {
+		c.Retention.Interval = time.Minute
+	}
+	if c.Compaction.Interval == 0 {
+		c.Compaction.Interval = time.Minute
+	}
+	if c.Compaction.DeleteRetention == 0 {
+		c.Compaction.DeleteRetention = 24 * time.Hour
+	}
 	l := &Log{
 		Dir: dir,
 		Config: c,
@@ -56,17 +110,25 @@ func (l *Log) setup() error {
 			file.Name(),
 			path.Ext(file.Name()),
 		)
-		off, _ := strconv.ParseUint(offStr, 10, 0)
+		off, err := strconv.ParseUint(offStr, 10, 0)
+		if err != nil {
+			continue
+		}
 		baseOffsets = append(baseOffsets, off)
 	}
 	sort.Slice(baseOffsets, func(i, j int) bool {
 		return baseOffsets[i] < baseOffsets[j]
 	})
 	for i := 0; i < len(baseOffsets); i++ {
+		// every segment has a store and an index file, so each base offset shows up
+		// more than once. A crash can also leave a segment with only one of its files,
+		// which newSegment recreates, so we skip duplicates rather than assume pairs.
+		if i > 0 && baseOffsets[i] == baseOffsets[i-1] {
+			continue
+		}
 		if err = l.newSegment(baseOffsets[i]); err != nil {
 			return err
 		}
-		i++
 	}
 	if l.segments == nil {
 		if err = l.newSegment(
@@ -75,6 +137,26 @@ func (l *Log) setup() error {
 			return err
 		}
 	}
+	// compaction can remove a sealed segment's last records, so its index doesn't
+	// say where the segment ends. The next segment starts where it ends.
+	for i := 0; i < len(l.segments)-1; i++ {
+		l.segments[i].nextOffset = l.segments[i+1].baseOffset
+	}
+	if err = l.registerMetrics(); err != nil {
+		return err
+	}
+	l.synced = newSyncWaiter()
+	l.appended = make(chan struct{})
+	l.stop = make(chan struct{})
+	if l.Config.Durability.Policy == SyncInterval {
+		go l.syncEvery(l.Config.Durability.Interval, l.stop)
+	}
+	if l.Config.Retention.MaxBytes > 0 || l.Config.Retention.MaxAge > 0 {
+		go l.retainEvery(l.Config.Retention.Interval, l.stop)
+	}
+	if l.Config.Compaction.Enabled {
+		go l.compactEvery(l.Config.Compaction.Interval, l.stop)
+	}
 	return nil
 }
 
@@ -84,23 +166,275 @@ func (l *Log) setup() error {
 // to coordinate access to this section of the code. We use a RWMutex to grant access to reads
 // when there isn't a write holding the lock. If you felt so inclined, you could optimze this
 // further and make the locks per segment rather than across the whole log.
+//
+// Once the record is in the log, Append syncs it to stable storage as the durability
+// policy says, so when Append returns the record is as durable as the policy promises.
 func (l *Log) Append(record *api.Record) (uint64, error) {
 	l.mu.Lock()
-	defer l.mu.Unlock()
+	if err := l.writable(); err != nil {
+		l.mu.Unlock()
+		return 0, err
+	}
+	size := l.activeSegment.store.size
 	off, err := l.activeSegment.Append(record)
 	if err != nil {
+		l.mu.Unlock()
 		return 0, err
 	}
+	l.metrics.appendedRecords.Inc()
+	l.metrics.appendedBytes.Add(float64(l.activeSegment.store.size - size))
+	l.notify()
 	if l.activeSegment.IsMaxed() {
 		err = l.newSegment(off + 1)
 	}
-	return off, err
+	if err == nil {
+		err = l.maybeSync(1)
+	}
+	synced := l.synced
+	l.mu.Unlock()
+	if err != nil {
+		return off, err
+	}
+	return off, l.waitForSync(synced)
 }
 
-// Read reads the record stored at the given offset.
+// AppendAt appends the record under the offset it already has, instead of the log's next
+// offset, so a follower's log keeps the same offsets as its leader's. The offset must be at or
+// after the log's next offset, or AppendAt returns ErrOffsetOutOfRange. A record further on
+// leaves a gap, like compaction does, where the leader compacted or removed records, and an
+// empty log starts over at the record's offset, as if Segment.InitialOffset had said so.
+// Followers are read-only to everyone but their replicator, so AppendAt ignores SetReadOnly.
+func (l *Log) AppendAt(record *api.Record) error {
+	l.mu.Lock()
+	if l.closed() {
+		l.mu.Unlock()
+		return api.ErrLogClosed{}
+	}
+	if record.Offset < l.activeSegment.nextOffset {
+		l.mu.Unlock()
+		return api.ErrOffsetOutOfRange{Offset: record.Offset}
+	}
+	var err error
+	if record.Offset > l.activeSegment.nextOffset {
+		err = l.skipTo(record.Offset)
+	}
+	size := l.activeSegment.store.size
+	if err == nil {
+		err = l.activeSegment.write(record)
+	}
+	if err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	l.metrics.appendedRecords.Inc()
+	l.metrics.appendedBytes.Add(float64(l.activeSegment.store.size - size))
+	l.notify()
+	if l.activeSegment.IsMaxed() {
+		err = l.newSegment(record.Offset + 1)
+	}
+	if err == nil {
+		err = l.maybeSync(1)
+	}
+	synced := l.synced
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return l.waitForSync(synced)
+}
+
+// skipTo gets the log ready to append at off, past its next offset. An empty active segment
+// makes way for one that starts at off, and so does a full one's, if the gap is too big for
+// its index's relative offsets. The caller must hold the lock.
+func (l *Log) skipTo(off uint64) error {
+	s := l.activeSegment
+	if s.store.size > 0 && off-s.baseOffset <= math.MaxUint32 {
+		return nil
+	}
+	if s.store.size == 0 {
+		if err := s.Remove(); err != nil {
+			return err
+		}
+		l.segments = l.segments[:len(l.segments)-1]
+		l.activeSegment = nil
+	}
+	// like setup does, we extend the previous segment over the gap.
+	if n := len(l.segments); n > 0 {
+		l.activeSegment = l.segments[n-1]
+		l.activeSegment.nextOffset = off
+	}
+	return l.newSegment(off)
+}
+
+// AppendBatch appends the records to the log under contiguous offsets and returns them.
+// The batch is all or nothing: if any record fails to append, we remove the segments the batch
+// made and rewind the active segment to where it was before the batch, so none of the records
+// make it into the log. Taking the lock once for the whole batch also saves high-volume producers
+// from paying for it on every record.
+func (l *Log) AppendBatch(records []*api.Record) ([]uint64, error) {
+	l.mu.Lock()
+	if err := l.writable(); err != nil {
+		l.mu.Unlock()
+		return nil, err
+	}
+	offsets, err := l.appendBatch(records)
+	if err == nil {
+		l.notify()
+		err = l.maybeSync(uint64(len(records)))
+	}
+	synced := l.synced
+	l.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return offsets, l.waitForSync(synced)
+}
+
+// appendBatch appends the records for AppendBatch. The caller must hold the lock.
+func (l *Log) appendBatch(records []*api.Record) ([]uint64, error) {
+	n := len(l.segments)
+	mark := l.activeSegment.mark()
+	offsets := make([]uint64, 0, len(records))
+	var bytes uint64
+	for _, record := range records {
+		size := l.activeSegment.store.size
+		off, err := l.activeSegment.Append(record)
+		if err == nil {
+			bytes += l.activeSegment.store.size - size
+		}
+		if err == nil && l.activeSegment.IsMaxed() {
+			err = l.newSegment(off + 1)
+		}
+		if err != nil {
+			if rerr := l.rollback(n, mark); rerr != nil {
+				return nil, rerr
+			}
+			return nil, err
+		}
+		offsets = append(offsets, off)
+	}
+	l.metrics.appendedRecords.Add(float64(len(records)))
+	l.metrics.appendedBytes.Add(float64(bytes))
+	return offsets, nil
+}
+
+// rollback removes every segment after the first n and rewinds the nth, which was
+// the active segment, to the given mark. The caller must hold the lock.
+func (l *Log) rollback(n int, mark segmentMark) error {
+	for _, s := range l.segments[n:] {
+		if err := s.Remove(); err != nil {
+			return err
+		}
+	}
+	l.segments = l.segments[:n]
+	l.activeSegment = l.segments[n-1]
+	return l.activeSegment.rewind(mark)
+}
+
+// SetReadOnly sets whether the log is read-only. A read-only log serves reads as usual,
+// but appends fail with ErrReadOnly.
+func (l *Log) SetReadOnly(readOnly bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.readOnly = readOnly
+}
+
+// Writable returns nil if the log takes appends, or the error an append would fail with:
+// ErrLogClosed or ErrReadOnly.
+func (l *Log) Writable() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.writable()
+}
+
+// writable returns an error if the log can't take appends. The caller must hold the lock.
+func (l *Log) writable() error {
+	if l.closed() {
+		return api.ErrLogClosed{}
+	}
+	if l.readOnly {
+		return api.ErrReadOnly{}
+	}
+	return nil
+}
+
+// closed returns whether the log is closed. The caller must hold the lock.
+func (l *Log) closed() bool {
+	return l.stop == nil
+}
+
+// notify wakes up everyone waiting for new records. The caller must hold the lock.
+func (l *Log) notify() {
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
+// maybeSync counts n more appended records and syncs the log if the durability
+// policy says it's time. The caller must hold the lock.
+func (l *Log) maybeSync(n uint64) error {
+	l.unsynced += n
+	switch l.Config.Durability.Policy {
+	case SyncEveryAppend:
+		return l.sync()
+	case SyncEveryN:
+		if l.unsynced >= l.Config.Durability.Records {
+			return l.sync()
+		}
+	}
+	return nil
+}
+
+// sync flushes the active segment to stable storage and wakes up the appends waiting for
+// the sync. The segments before the active segment were synced when the log rolled over them.
+// The caller must hold the lock.
+func (l *Log) sync() error {
+	err := l.activeSegment.Sync()
+	l.unsynced = 0
+	l.synced.err = err
+	close(l.synced.done)
+	l.synced = newSyncWaiter()
+	return err
+}
+
+// waitForSync waits for the given sync when the durability policy makes appends wait for
+// the next periodic sync, and returns its error.
+func (l *Log) waitForSync(synced *syncWaiter) error {
+	if l.Config.Durability.Policy != SyncInterval {
+		return nil
+	}
+	<-synced.done
+	return synced.err
+}
+
+// syncEvery syncs the log every interval, if anything was appended since the last sync,
+// until stop is closed.
+func (l *Log) syncEvery(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			if l.unsynced > 0 {
+				if err := l.sync(); err != nil {
+					zap.L().Named("log").Error("sync failed", zap.Error(err))
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// Read reads the record stored at the given offset. If compaction removed that record,
+// Read returns the next record in the log instead, so check the returned record's offset.
 func (l *Log) Read(off uint64) (*api.Record, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	if l.closed() {
+		return nil, api.ErrLogClosed{}
+	}
 	var s *segment
 	// First, find the segment that contains the given record.
 	// Since the segments are in order from oldest to newest
@@ -110,22 +444,105 @@ func (l *Log) Read(off uint64) (*api.Record, error) {
 	// Once we know the segment that contains the record, we get the index
 	// entry from the segment's index, and we read the data out of the segment's
 	// store file and return the data to the caller.
-	for _, segment := range l.segments {
-		if segment.baseOffset <= off && off < segment.nextOffset {
-			s = segment
+	i := 0
+	for ; i < len(l.segments); i++ {
+		if l.segments[i].baseOffset <= off && off < l.segments[i].nextOffset {
+			s = l.segments[i]
 			break
 		}
 	}
 	if s == nil || s.nextOffset <= off {
 		return nil, api.ErrOffsetOutOfRange{Offset: off}
 	}
-	return s.Read(off)
+	// the segment returns io.EOF when compaction removed every record from the offset
+	// to its end, so we move on to the following segments. The active segment is never
+	// compacted, so we always end up with a record.
+	for ; i < len(l.segments); i++ {
+		if off < l.segments[i].baseOffset {
+			off = l.segments[i].baseOffset
+		}
+		record, err := l.segments[i].Read(off)
+		if err != io.EOF {
+			return record, err
+		}
+	}
+	return nil, api.ErrOffsetOutOfRange{Offset: off}
+}
+
+// Wait blocks until the log has a record at or after the given offset, so a consumer that
+// has read everything can wait for the next record without polling. It returns right away if
+// the log already has the offset. Wait returns ErrOffsetOutOfRange if the log removed the offset
+// (no record will ever show up there), the context's error if the context is done first, and an
+// error if the log closes first.
+func (l *Log) Wait(ctx context.Context, off uint64) error {
+	for {
+		l.mu.RLock()
+		if l.closed() {
+			l.mu.RUnlock()
+			return api.ErrLogClosed{}
+		}
+		if off < l.segments[0].baseOffset {
+			l.mu.RUnlock()
+			return api.ErrOffsetOutOfRange{Offset: off}
+		}
+		if off < l.activeSegment.nextOffset {
+			l.mu.RUnlock()
+			return nil
+		}
+		appended, stop := l.appended, l.stop
+		l.mu.RUnlock()
+		select {
+		case <-appended:
+		case <-stop:
+			return api.ErrLogClosed{}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// OffsetForTime returns the offset of the first record appended at or after t. We
+// binary search the segments for the first one with a record at or after t, then the segment
+// finds the record with its time index. If the log has no records that late, OffsetForTime
+// returns the offset the next record will get, so a consumer starting there waits for new records.
+func (l *Log) OffsetForTime(t time.Time) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed() {
+		return 0, api.ErrLogClosed{}
+	}
+	ts := t.UnixNano()
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].maxTimestamp >= ts
+	})
+	for ; i < len(l.segments); i++ {
+		off, ok, err := l.segments[i].OffsetForTime(ts)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return off, nil
+		}
+	}
+	return l.activeSegment.nextOffset, nil
 }
 
-// Close iterates over the segments and closes them
+// Close iterates over the segments and closes them. First, it stops the background goroutines
+// and syncs whatever is left, so no append is left waiting.
 func (l *Log) Close() error {
+	l.compacting.Lock()
+	defer l.compacting.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+	if l.synced != nil {
+		if err := l.sync(); err != nil {
+			return err
+		}
+	}
 	for _, segment := range l.segments {
 		if err := segment.Close(); err != nil {
 			return err
@@ -142,11 +559,20 @@ func (l *Log) Remove() error {
 	return os.RemoveAll(l.Dir)
 }
 
-// Reset removes the log then creates a new log to replace it
+// Reset removes the log then creates a new, empty log to replace it, in the same
+// directory, starting at Segment.InitialOffset.
 func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Remove took the directory with it, and the segments we had are gone.
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	l.segments = nil
+	l.activeSegment = nil
 	return l.setup()
 }
 
@@ -171,10 +597,21 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
+// NextOffset returns the offset the log gives the next record it appends. The log is empty
+// when it's the same as LowestOffset.
+func (l *Log) NextOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.activeSegment.nextOffset, nil
+}
+
 // Truncate removes all segments whose highest offset is lower than lowest.
 // Because we don't have disks with infinte space, we'll periodically call Truncate()
 // to remove old segments whose data we (hopefully) have processed by then amd don't need anymore.
+// If that's every segment, the log starts over, empty, after lowest.
 func (l *Log) Truncate(lowest uint64) error {
+	l.compacting.Lock()
+	defer l.compacting.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	var segments []*segment
@@ -188,18 +625,70 @@ func (l *Log) Truncate(lowest uint64) error {
 		segments = append(segments, s)
 	}
 	l.segments = segments
+	if len(segments) == 0 {
+		l.activeSegment = nil
+		return l.newSegment(lowest + 1)
+	}
+	return nil
+}
+
+// Rewind removes the records at off and after it, so the next record the log appends
+// gets off. It's the opposite of Truncate, for when the newest records turn out to be wrong,
+// like the entries a Raft leader didn't commit before it lost its leadership.
+func (l *Log) Rewind(off uint64) error {
+	l.compacting.Lock()
+	defer l.compacting.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed() {
+		return api.ErrLogClosed{}
+	}
+	if off < l.segments[0].baseOffset {
+		return api.ErrOffsetOutOfRange{Offset: off}
+	}
+	// we remove the segments that start at off or later, unless that's all of them, and
+	// rewind the one off is in.
+	for n := len(l.segments); n > 1 && l.segments[n-1].baseOffset >= off; n-- {
+		if err := l.segments[n-1].Remove(); err != nil {
+			return err
+		}
+		l.segments = l.segments[:n-1]
+	}
+	s := l.segments[len(l.segments)-1]
+	l.activeSegment = s
+	if off < s.nextOffset {
+		rel := uint32(off - s.baseOffset)
+		entry := s.index.Search(rel)
+		mark := s.mark()
+		mark.nextOffset = off
+		mark.indexSize = uint64(entry) * entWidth
+		if _, pos, err := s.index.Read(entry); err == nil {
+			mark.storeSize = pos
+		}
+		for mark.timeEntries > 0 && s.timeIndex.entries[mark.timeEntries-1].off >= rel {
+			mark.timeEntries--
+		}
+		if err := s.rewind(mark); err != nil {
+			return err
+		}
+	}
+	// the segment we ended up with may still be full, if it was sealed and we didn't rewind it.
+	if s.IsMaxed() {
+		return l.newSegment(s.nextOffset)
+	}
 	return nil
 }
 
 // Reader returns an io.Reader to read the whole log. We'll need this capability
 // when we implement coordinate consensus and need to support snapshots and restoring a log.
-// Reader uses an io.MultiReader() call to concatenate the segments'stores.
+// Reader uses an io.MultiReader() call to concatenate the segments'stores. It reads the
+// stores as they are when we call Reader, so records appended later don't sneak into a snapshot.
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	readers := make([]io.Reader, len(l.segments))
 	for i, segment := range l.segments {
-		readers[i] = &originReader{segment.store, 0}
+		readers[i] = io.LimitReader(&originReader{segment.store, 0}, int64(segment.store.size))
 	}
 	return io.MultiReader(readers...)
 }
@@ -224,10 +713,23 @@ func (o *originReader) Read(p []byte) (int, error) {
 // slice of segments, and makes the new segment the active segment so that
 // subsequent append calls write to it.
 func (l *Log) newSegment(off uint64) error {
+	// sync the segment we're rolling over before we make a new one, since
+	// the log only ever syncs its active segment.
+	if l.activeSegment != nil && l.Config.Durability.Policy != SyncNever {
+		if err := l.activeSegment.Sync(); err != nil {
+			return err
+		}
+	}
 	s, err := newSegment(l.Dir, off, l.Config)
 	if err != nil {
 		return err
 	}
+	// Timestamps can go backwards (a producer can set its own, and clocks jump), so
+	// a segment's latest timestamp is at least the previous segment's. That keeps the
+	// segments sorted by time for OffsetForTime's binary search.
+	if n := len(l.segments); n > 0 && l.segments[n-1].maxTimestamp > s.maxTimestamp {
+		s.maxTimestamp = l.segments[n-1].maxTimestamp
+	}
 	l.segments = append(l.segments, s)
 	l.activeSegment = s
 	return nil
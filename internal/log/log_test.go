@@ -1,9 +1,11 @@
 package log
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	api "github.com/hafizmfadli/proglog/api/v1"
@@ -22,6 +24,18 @@ func TestLog(t *testing.T) {
 		"init with existing segments": testInitExisting,
 		"reader": testReader,
 		"truncate": testTruncate,
+		"corrupt record error": testCorruptRecordErr,
+		"offset for time": testOffsetForTime,
+		"append and read keys and headers": testAppendReadKeyHeaders,
+		"append batch": testAppendBatch,
+		"append batch is all or nothing": testAppendBatchRollback,
+		"wait for an offset": testWait,
+		"record too large error": testRecordTooLargeErr,
+		"read only error": testReadOnlyErr,
+		"closed log error": testClosedErr,
+		"append at an offset": testAppendAt,
+		"rewind": testRewind,
+		"reset": testReset,
 	}{
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
@@ -113,7 +127,7 @@ func testReader(t *testing.T, log *Log) {
 	require.NoError(t, err)
 
 	read := &api.Record{}
-	err = proto.Unmarshal(b[lenWidth:], read)
+	err = proto.Unmarshal(b[lenWidth+crcWidth:], read)
 	require.NoError(t, err)
 	require.Equal(t, append.Value, read.Value)
 }
@@ -134,4 +148,374 @@ func testTruncate(t *testing.T, log *Log) {
 
 	_, err = log.Read(0)
 	require.Error(t, err)
-}
\ No newline at end of file
+}
+
+// testCorruptRecordErr tests that the log returns an api.ErrCorruptRecord, telling us
+// which segment and position are damaged, when a record's bytes changed on disk.
+func testCorruptRecordErr(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	off, err := log.Append(append)
+	require.NoError(t, err)
+
+	s := log.segments[0]
+	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	require.NoError(t, err)
+	require.NoError(t, s.store.buf.Flush())
+
+	// the store's file is opened with O_APPEND, so we damage the record through another handle.
+	f, err := os.OpenFile(s.store.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("J"), int64(pos+lenWidth+crcWidth+2))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	read, err := log.Read(off)
+	require.Nil(t, read)
+	apiErr := err.(api.ErrCorruptRecord)
+	require.Equal(t, off, apiErr.Offset)
+	require.Equal(t, s.baseOffset, apiErr.BaseOffset)
+	require.Equal(t, pos, apiErr.Position)
+}
+
+// testOffsetForTime tests that we can find the first record appended at or after a
+// given time, across segments and after the log restarts from disk.
+func testOffsetForTime(t *testing.T, log *Log) {
+	start := time.Unix(0, 1000)
+	for i := int64(0); i < 10; i++ {
+		_, err := log.Append(&api.Record{
+			Value:     []byte("hello world"),
+			Timestamp: start.Add(time.Duration(i * 10)).UnixNano(),
+		})
+		require.NoError(t, err)
+	}
+	require.True(t, len(log.segments) > 1)
+
+	check := func(log *Log) {
+		for _, tc := range []struct {
+			t    time.Time
+			want uint64
+		}{
+			{t: time.Unix(0, 0), want: 0},
+			{t: start, want: 0},
+			{t: start.Add(1), want: 1},
+			{t: start.Add(50), want: 5},
+			{t: start.Add(55), want: 6},
+			{t: start.Add(90), want: 9},
+			{t: start.Add(91), want: 10},
+		} {
+			off, err := log.OffsetForTime(tc.t)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, off)
+		}
+	}
+	check(log)
+
+	require.NoError(t, log.Close())
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	check(n)
+}
+
+// testAppendReadKeyHeaders tests that a record's key, headers and timestamp
+// come back from the log the way we appended them.
+func testAppendReadKeyHeaders(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value:     []byte("hello world"),
+		Key:       []byte("user-1"),
+		Timestamp: 42,
+		Headers: []*api.Header{
+			{Key: "trace-id", Value: []byte("abc")},
+			{Key: "content-type", Value: []byte("text/plain")},
+		},
+	}
+	off, err := log.Append(append)
+	require.NoError(t, err)
+
+	read, err := log.Read(off)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(append, read))
+}
+
+// testAppendBatch tests that a batch gets contiguous offsets, even when it rolls
+// the log over to new segments, and that we can read every record back.
+func testAppendBatch(t *testing.T, log *Log) {
+	var batch []*api.Record
+	for i := 0; i < 5; i++ {
+		batch = append(batch, &api.Record{
+			Value: []byte("hello world"),
+		})
+	}
+	offsets, err := log.AppendBatch(batch)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2, 3, 4}, offsets)
+	require.True(t, len(log.segments) > 1)
+
+	for _, off := range offsets {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, batch[0].Value, read.Value)
+	}
+}
+
+// testAppendBatchRollback tests that when a record in a batch fails to append,
+// none of the batch's records make it into the log, including the segments it rolled over to.
+func testAppendBatchRollback(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	segments := len(log.segments)
+
+	batch := []*api.Record{
+		{Value: []byte("hello world")},
+		{Value: []byte("hello world")},
+		{Value: []byte("hello world")},
+		// proto refuses to marshal strings that aren't valid UTF-8.
+		{Value: []byte("hello world"), Headers: []*api.Header{{Key: "\xff"}}},
+	}
+	_, err = log.AppendBatch(batch)
+	require.Error(t, err)
+	require.Equal(t, segments, len(log.segments))
+
+	_, err = log.Read(1)
+	require.Error(t, err)
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	// the log carries on from where it was before the batch.
+	off, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	read, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+}
+
+// TestLogDurability tests that the log syncs appended records to stable storage
+// when its durability policy says to. A synced segment has nothing left in its store's buffer.
+func TestLogDurability(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		policy SyncPolicy
+		// appends is how many times the log has synced the active segment's store and
+		// index after each of three appends, and batch after a batch of two more records.
+		appends []uint64
+		batch   uint64
+	}{
+		"never":        {policy: SyncNever, appends: []uint64{0, 0, 0}, batch: 0},
+		"every append": {policy: SyncEveryAppend, appends: []uint64{1, 2, 3}, batch: 4},
+		"every n":      {policy: SyncEveryN, appends: []uint64{0, 1, 1}, batch: 2},
+		"interval":     {policy: SyncInterval, appends: []uint64{1, 2, 3}, batch: 4},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "durability-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Durability.Policy = tc.policy
+			c.Durability.Records = 2
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			requireSyncs := func(want uint64) {
+				t.Helper()
+				log.mu.RLock()
+				defer log.mu.RUnlock()
+				require.Equal(t, want, log.activeSegment.store.syncs)
+				require.Equal(t, want, log.activeSegment.index.syncs)
+			}
+
+			for _, want := range tc.appends {
+				_, err := log.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+				requireSyncs(want)
+			}
+
+			// batches sync once for the whole batch.
+			_, err = log.AppendBatch([]*api.Record{
+				{Value: []byte("hello world")},
+				{Value: []byte("hello world")},
+			})
+			require.NoError(t, err)
+			requireSyncs(tc.batch)
+		})
+	}
+}
+
+// testWait tests that Wait returns once the log appends the offset we're waiting for,
+// and gives up when the context is done or the log closes.
+func testWait(t *testing.T, log *Log) {
+	ctx := context.Background()
+	done := make(chan error)
+	go func() {
+		done <- log.Wait(ctx, 1)
+	}()
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	select {
+	case err = <-done:
+		t.Fatalf("wait returned before offset 1 was appended: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, <-done)
+
+	// the log already has the offset.
+	require.NoError(t, log.Wait(ctx, 0))
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, log.Wait(ctx, 2))
+
+	go func() {
+		done <- log.Wait(context.Background(), 2)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, log.Close())
+	require.Equal(t, api.ErrLogClosed{}, <-done)
+}
+
+// testRecordTooLargeErr tests that the log refuses records bigger than MaxRecordBytes.
+func testRecordTooLargeErr(t *testing.T, log *Log) {
+	log.Config.Segment.MaxRecordBytes = 8
+	log.activeSegment.config = log.Config
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.IsType(t, api.ErrRecordTooLarge{}, err)
+	require.Equal(t, uint64(8), err.(api.ErrRecordTooLarge).Max)
+	_, err = log.Read(0)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+}
+
+// testReadOnlyErr tests that a read-only log refuses appends but still serves reads.
+func testReadOnlyErr(t *testing.T, log *Log) {
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	log.SetReadOnly(true)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, api.ErrReadOnly{}, err)
+	_, err = log.AppendBatch([]*api.Record{{Value: []byte("hello world")}})
+	require.Equal(t, api.ErrReadOnly{}, err)
+	_, err = log.Read(off)
+	require.NoError(t, err)
+	log.SetReadOnly(false)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+}
+
+// testClosedErr tests that a closed log says so instead of failing on its closed files.
+func testClosedErr(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, api.ErrLogClosed{}, err)
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrLogClosed{}, err)
+	_, err = log.OffsetForTime(time.Now())
+	require.Equal(t, api.ErrLogClosed{}, err)
+}
+
+// testAppendAt tests that a follower's log keeps the offsets of the records it replicates,
+// starting an empty log at the first one and leaving gaps where the leader has them.
+func testAppendAt(t *testing.T, log *Log) {
+	log.SetReadOnly(true)
+	for _, off := range []uint64{5, 6, 9} {
+		require.NoError(t, log.AppendAt(&api.Record{Value: []byte("hello world"), Offset: off}))
+	}
+	err := log.AppendAt(&api.Record{Value: []byte("hello world"), Offset: 9})
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 9}, err)
+
+	check := func(log *Log) {
+		lowest, err := log.LowestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(5), lowest)
+		next, err := log.NextOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(10), next)
+		// reading the gap gets the next record.
+		record, err := log.Read(7)
+		require.NoError(t, err)
+		require.Equal(t, uint64(9), record.Offset)
+		it := log.NewIterator(0)
+		defer it.Close()
+		_ = it.Next()
+		require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, it.Err())
+		var offsets []uint64
+		it = log.NewIterator(5)
+		for it.Next() {
+			offsets = append(offsets, it.Record().Offset)
+		}
+		require.NoError(t, it.Err())
+		require.Equal(t, []uint64{5, 6, 9}, offsets)
+	}
+	check(log)
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+	check(log)
+}
+
+// testRewind tests that Rewind removes the newest records, whether they have segments of
+// their own or share one with older records, and that the log appends after them again.
+func testRewind(t *testing.T, log *Log) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	dir, err := ioutil.TempDir("", "rewind-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	shared, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer shared.Close()
+	for _, l := range []*Log{log, shared} {
+		for i := 0; i < 5; i++ {
+			_, err := l.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+		require.NoError(t, l.Rewind(2))
+		next, err := l.NextOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), next)
+		_, err = l.Read(2)
+		require.Equal(t, api.ErrOffsetOutOfRange{Offset: 2}, err)
+		off, err := l.Append(&api.Record{Value: []byte("hello again")})
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), off)
+		record, err := l.Read(1)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), record.Value)
+		record, err = l.Read(2)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello again"), record.Value)
+	}
+	require.NoError(t, log.Truncate(1))
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 1}, log.Rewind(1))
+}
+
+// testReset tests that Reset leaves an empty log, starting at the initial offset, that
+// takes appends, and that Truncate does too when it removes every segment.
+func testReset(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Truncate(5))
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), lowest)
+
+	log.Config.Segment.InitialOffset = 10
+	require.NoError(t, log.Reset())
+	defer log.Close()
+	lowest, err = log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), lowest)
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+	_, err = log.Read(10)
+	require.NoError(t, err)
+}
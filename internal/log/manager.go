@@ -0,0 +1,482 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultTopic is the topic requests go to when they don't name one.
+const DefaultTopic = "default"
+
+// topicConfigFile is the file in a topic's directory with the topic's config overrides.
+// Its name isn't an offset, so the topic's log skips it.
+const topicConfigFile = "topic.yaml"
+
+// topicName is what topic names look like. They name directories, so they can't have slashes.
+// Names starting with "__" are the manager's own, like the log of committed offsets.
+var topicName = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+// TopicConfig overrides the manager's log config for a topic. Fields left at zero keep
+// the manager's defaults.
+type TopicConfig struct {
+	MaxStoreBytes  uint64        `yaml:"max_store_bytes,omitempty"`
+	MaxIndexBytes  uint64        `yaml:"max_index_bytes,omitempty"`
+	MaxRecordBytes uint64        `yaml:"max_record_bytes,omitempty"`
+	RetentionBytes uint64        `yaml:"retention_bytes,omitempty"`
+	RetentionAge   time.Duration `yaml:"retention_age,omitempty"`
+	// Compact turns on compaction for the topic.
+	Compact bool `yaml:"compact,omitempty"`
+	// Partitions is how many partitions the topic has. Defaults to 1.
+	Partitions uint32 `yaml:"partitions,omitempty"`
+}
+
+// apply returns the log config with the topic's overrides.
+func (tc TopicConfig) apply(c Config) Config {
+	if tc.MaxStoreBytes != 0 {
+		c.Segment.MaxStoreBytes = tc.MaxStoreBytes
+	}
+	if tc.MaxIndexBytes != 0 {
+		c.Segment.MaxIndexBytes = tc.MaxIndexBytes
+	}
+	if tc.MaxRecordBytes != 0 {
+		c.Segment.MaxRecordBytes = tc.MaxRecordBytes
+	}
+	if tc.RetentionBytes != 0 {
+		c.Retention.MaxBytes = tc.RetentionBytes
+	}
+	if tc.RetentionAge != 0 {
+		c.Retention.MaxAge = tc.RetentionAge
+	}
+	if tc.Compact {
+		c.Compaction.Enabled = true
+	}
+	return c
+}
+
+// TopicConfigFromProto converts the topic config from the protobuf form clients and
+// followers send it in.
+func TopicConfigFromProto(c *api.TopicConfig) TopicConfig {
+	if c == nil {
+		return TopicConfig{}
+	}
+	return TopicConfig{
+		MaxStoreBytes:  c.MaxStoreBytes,
+		MaxIndexBytes:  c.MaxIndexBytes,
+		MaxRecordBytes: c.MaxRecordBytes,
+		RetentionBytes: c.RetentionBytes,
+		RetentionAge:   time.Duration(c.RetentionMs) * time.Millisecond,
+		Compact:        c.Compact,
+		Partitions:     c.Partitions,
+	}
+}
+
+// Proto converts the topic config to its protobuf form.
+func (tc TopicConfig) Proto() *api.TopicConfig {
+	return &api.TopicConfig{
+		MaxStoreBytes:  tc.MaxStoreBytes,
+		MaxIndexBytes:  tc.MaxIndexBytes,
+		MaxRecordBytes: tc.MaxRecordBytes,
+		RetentionBytes: tc.RetentionBytes,
+		RetentionMs:    int64(tc.RetentionAge / time.Millisecond),
+		Compact:        tc.Compact,
+		Partitions:     tc.Partitions,
+	}
+}
+
+// partitions returns how many partitions the topic has.
+func (tc TopicConfig) partitions() uint32 {
+	if tc.Partitions == 0 {
+		return 1
+	}
+	return tc.Partitions
+}
+
+// Topic is a topic the manager has, along with its config overrides.
+type Topic struct {
+	Name   string
+	Config TopicConfig
+}
+
+// ManagerConfig configures a LogManager.
+type ManagerConfig struct {
+	// Log is the config of every partition's log, before the topic's overrides. The manager
+	// adds topic and partition labels to the metrics of each partition's log.
+	Log Config
+	// AutoCreateTopics creates a topic, with the default config, the first time someone
+	// uses it. Otherwise only CreateTopic creates topics.
+	AutoCreateTopics bool
+	// ReadOnly makes the logs of every partition read-only, for a follower, whose replicator
+	// appends to them with Log.AppendAt.
+	ReadOnly bool
+}
+
+// LogManager owns the topics, each split into partitions that each have their own log, so
+// every partition has its own offsets and appends to different partitions don't wait on each
+// other. A topic lives in a directory named after it under the manager's directory, with the
+// file that keeps the topic's config overrides, so topics survive restarts, and a directory
+// for each partition's log, named after the partition.
+type LogManager struct {
+	Dir    string
+	Config ManagerConfig
+
+	mu      sync.RWMutex
+	topics  map[string]*topic
+	offsets *OffsetStore
+	closed  bool
+}
+
+type topic struct {
+	config      TopicConfig
+	partitions  []*Log
+	partitioner Partitioner
+}
+
+// NewLogManager opens the topics under dir, and creates the default topic if it doesn't
+// exist, so requests that don't name a topic always have one. A directory that holds a
+// single log's segments, from before the server had topics, becomes the default topic,
+// and a topic directory that holds a log, from before topics had partitions, becomes
+// the topic's first partition. The manager also keeps the consumer groups' committed offsets
+// (see Offsets).
+func NewLogManager(dir string, c ManagerConfig) (*LogManager, error) {
+	m := &LogManager{
+		Dir:    dir,
+		Config: c,
+		topics: make(map[string]*topic),
+	}
+	if err := moveSegments(dir, path.Join(dir, DefaultTopic, "0")); err != nil {
+		return nil, err
+	}
+	if err := m.openOffsets(); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	for _, file := range files {
+		if !file.IsDir() || validTopic(file.Name()) != nil {
+			continue
+		}
+		tdir := path.Join(dir, file.Name())
+		if err = moveSegments(tdir, path.Join(tdir, "0")); err != nil {
+			m.Close()
+			return nil, err
+		}
+		var tc TopicConfig
+		b, err := ioutil.ReadFile(path.Join(tdir, topicConfigFile))
+		if err != nil && !os.IsNotExist(err) {
+			m.Close()
+			return nil, err
+		}
+		if err = yaml.Unmarshal(b, &tc); err != nil {
+			m.Close()
+			return nil, err
+		}
+		if err = m.open(file.Name(), tc); err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+	if _, ok := m.topics[DefaultTopic]; !ok {
+		if err = m.CreateTopic(DefaultTopic, TopicConfig{}); err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// moveSegments moves the segment files in the from directory to the to directory.
+func moveSegments(from, to string) error {
+	files, err := ioutil.ReadDir(from)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if _, err := strconv.ParseUint(strings.TrimSuffix(name, path.Ext(name)), 10, 0); err != nil || file.IsDir() {
+			continue
+		}
+		if err = os.MkdirAll(to, 0755); err != nil {
+			return err
+		}
+		if err = os.Rename(path.Join(from, name), path.Join(to, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openOffsets opens the offset store, in its own directory with the manager's log config.
+func (m *LogManager) openOffsets() error {
+	dir := path.Join(m.Dir, offsetsTopic)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	c := m.Config.Log
+	c.Metrics.Labels = m.labels(offsetsTopic, 0)
+	offsets, err := NewOffsetStore(dir, c)
+	if err != nil {
+		return err
+	}
+	m.offsets = offsets
+	return nil
+}
+
+// labels returns the metric labels of the topic's partition.
+func (m *LogManager) labels(topic string, partition uint32) prometheus.Labels {
+	labels := prometheus.Labels{
+		"topic":     topic,
+		"partition": strconv.FormatUint(uint64(partition), 10),
+	}
+	for k, v := range m.Config.Log.Metrics.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// validTopic returns api.ErrInvalidTopic if the topic's name isn't valid.
+func validTopic(topic string) error {
+	if !topicName.MatchString(topic) || topic == "." || topic == ".." || strings.HasPrefix(topic, "__") {
+		return api.ErrInvalidTopic{Topic: topic}
+	}
+	return nil
+}
+
+// open opens the logs of the topic's partitions, with the topic's config. The caller must
+// hold the lock, or be the only one with the manager.
+func (m *LogManager) open(name string, tc TopicConfig) error {
+	t := &topic{config: tc}
+	for p := uint32(0); p < tc.partitions(); p++ {
+		c := tc.apply(m.Config.Log)
+		c.Metrics.Labels = m.labels(name, p)
+		dir := path.Join(m.Dir, name, strconv.FormatUint(uint64(p), 10))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		l, err := NewLog(dir, c)
+		if err != nil {
+			return err
+		}
+		l.SetReadOnly(m.Config.ReadOnly)
+		t.partitions = append(t.partitions, l)
+	}
+	m.topics[name] = t
+	return nil
+}
+
+// topic returns the topic, creating it if the manager creates topics on demand. An empty
+// topic is the default topic. topic returns api.ErrTopicNotFound if the topic doesn't exist
+// and the manager doesn't create it.
+func (m *LogManager) topic(name string) (*topic, error) {
+	if name == "" {
+		name = DefaultTopic
+	}
+	m.mu.RLock()
+	t, ok := m.topics[name]
+	closed := m.closed
+	m.mu.RUnlock()
+	switch {
+	case closed:
+		return nil, api.ErrLogClosed{}
+	case ok:
+		return t, nil
+	case !m.Config.AutoCreateTopics:
+		if err := validTopic(name); err != nil {
+			return nil, err
+		}
+		return nil, api.ErrTopicNotFound{Topic: name}
+	}
+	// someone else may create the topic in the meantime, which is fine.
+	if err := m.CreateTopic(name, TopicConfig{}); err != nil {
+		if _, ok := err.(api.ErrTopicExists); !ok {
+			return nil, err
+		}
+	}
+	return m.topic(name)
+}
+
+// Partitions returns the logs of the topic's partitions, in order.
+func (m *LogManager) Partitions(topic string) ([]*Log, error) {
+	t, err := m.topic(topic)
+	if err != nil {
+		return nil, err
+	}
+	return t.partitions, nil
+}
+
+// PartitionCount returns how many partitions the topic has. Unlike Partitions, it never
+// creates the topic, so it returns api.ErrTopicNotFound for a topic that doesn't exist, even
+// when the manager creates topics on demand. It suits callers that only look topics up, like
+// consumer group coordinators, which clients can ask about any topic.
+func (m *LogManager) PartitionCount(topic string) (uint32, error) {
+	if topic == "" {
+		topic = DefaultTopic
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return 0, api.ErrLogClosed{}
+	}
+	t, ok := m.topics[topic]
+	if !ok {
+		return 0, api.ErrTopicNotFound{Topic: topic}
+	}
+	return uint32(len(t.partitions)), nil
+}
+
+// Partition returns the log of the topic's partition, or api.ErrPartitionNotFound if the
+// topic doesn't have that partition.
+func (m *LogManager) Partition(topic string, partition uint32) (*Log, error) {
+	t, err := m.topic(topic)
+	if err != nil {
+		return nil, err
+	}
+	if partition >= uint32(len(t.partitions)) {
+		if topic == "" {
+			topic = DefaultTopic
+		}
+		return nil, api.ErrPartitionNotFound{Topic: topic, Partition: partition}
+	}
+	return t.partitions[partition], nil
+}
+
+// Route returns the partition of the topic, and its log, to append a record with the
+// given key to (see Partitioner).
+func (m *LogManager) Route(topic string, key []byte) (uint32, *Log, error) {
+	t, err := m.topic(topic)
+	if err != nil {
+		return 0, nil, err
+	}
+	p := t.partitioner.Partition(key, uint32(len(t.partitions)))
+	return p, t.partitions[p], nil
+}
+
+// CreateTopic creates the topic with the given config overrides, which it keeps in the
+// topic's directory. It returns api.ErrTopicExists if the topic exists.
+func (m *LogManager) CreateTopic(topic string, tc TopicConfig) error {
+	if err := validTopic(topic); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return api.ErrLogClosed{}
+	}
+	if _, ok := m.topics[topic]; ok {
+		return api.ErrTopicExists{Topic: topic}
+	}
+	dir := path.Join(m.Dir, topic)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := writeTopicConfig(dir, tc); err != nil {
+		return err
+	}
+	return m.open(topic, tc)
+}
+
+// writeTopicConfig writes the topic's config to a temporary file and then renames it into
+// place, so a crash can't leave half a config.
+func writeTopicConfig(dir string, tc TopicConfig) error {
+	b, err := yaml.Marshal(tc)
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(dir, topicConfigFile+".tmp")
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(dir, topicConfigFile))
+}
+
+// DeleteTopic closes the logs of the topic's partitions and removes its data, along with
+// the offsets consumer groups committed for it. Requests still using the logs fail with
+// api.ErrLogClosed.
+func (m *LogManager) DeleteTopic(topic string) error {
+	if topic == "" {
+		topic = DefaultTopic
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return api.ErrLogClosed{}
+	}
+	t, ok := m.topics[topic]
+	if !ok {
+		return api.ErrTopicNotFound{Topic: topic}
+	}
+	delete(m.topics, topic)
+	for _, l := range t.partitions {
+		l.unregisterMetrics()
+		if err := l.Remove(); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(path.Join(m.Dir, topic)); err != nil {
+		return err
+	}
+	return m.offsets.DeleteTopic(topic)
+}
+
+// Offsets returns the store of the offsets consumer groups commit for the partitions
+// they consume.
+func (m *LogManager) Offsets() *OffsetStore {
+	return m.offsets
+}
+
+// Topics returns the manager's topics, sorted by name.
+func (m *LogManager) Topics() []Topic {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	topics := make([]Topic, 0, len(m.topics))
+	for name, t := range m.topics {
+		topics = append(topics, Topic{Name: name, Config: t.config})
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Name < topics[j].Name
+	})
+	return topics
+}
+
+// Writable returns api.ErrLogClosed once the manager is closed. Each partition's log says
+// whether it takes writes itself.
+func (m *LogManager) Writable() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return api.ErrLogClosed{}
+	}
+	return nil
+}
+
+// Close closes the logs of every topic's partitions, and the offset store.
+func (m *LogManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	var err error
+	if m.offsets != nil {
+		err = m.offsets.Close()
+	}
+	for _, t := range m.topics {
+		for _, l := range t.partitions {
+			if cerr := l.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,181 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manager-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := NewLogManager(dir, ManagerConfig{})
+	require.NoError(t, err)
+	require.Equal(t, []Topic{{Name: DefaultTopic}}, m.Topics())
+
+	// every topic has its own offsets.
+	err = m.CreateTopic("orders", TopicConfig{MaxStoreBytes: 64, RetentionAge: time.Hour})
+	require.NoError(t, err)
+	orders, err := m.Partition("orders", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(64), orders.Config.Segment.MaxStoreBytes)
+	require.Equal(t, time.Hour, orders.Config.Retention.MaxAge)
+	def, err := m.Partition("", 0)
+	require.NoError(t, err)
+	for _, l := range []*Log{orders, def} {
+		off, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), off)
+	}
+
+	require.Equal(t, api.ErrTopicExists{Topic: "orders"}, m.CreateTopic("orders", TopicConfig{}))
+	_, err = m.Partitions("payments")
+	require.Equal(t, api.ErrTopicNotFound{Topic: "payments"}, err)
+	_, err = m.Partition("orders", 1)
+	require.Equal(t, api.ErrPartitionNotFound{Topic: "orders", Partition: 1}, err)
+	for _, topic := range []string{"a/b", "..", strings.Repeat("a", 250), "__consumer_offsets"} {
+		require.Equal(t, api.ErrInvalidTopic{Topic: topic}, m.CreateTopic(topic, TopicConfig{}))
+	}
+	require.NoError(t, m.Close())
+	_, err = m.Partitions("orders")
+	require.Equal(t, api.ErrLogClosed{}, err)
+
+	// the topics and their configs survive a restart, and the manager can create topics on demand.
+	m, err = NewLogManager(dir, ManagerConfig{AutoCreateTopics: true})
+	require.NoError(t, err)
+	defer m.Close()
+	require.Equal(t, []Topic{
+		{Name: DefaultTopic},
+		{Name: "orders", Config: TopicConfig{MaxStoreBytes: 64, RetentionAge: time.Hour}},
+	}, m.Topics())
+	orders, err = m.Partition("orders", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(64), orders.Config.Segment.MaxStoreBytes)
+	off, err := orders.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	// looking up how many partitions a topic has doesn't create it.
+	_, err = m.PartitionCount("refunds")
+	require.Equal(t, api.ErrTopicNotFound{Topic: "refunds"}, err)
+	_, err = os.Stat(path.Join(dir, "refunds"))
+	require.True(t, os.IsNotExist(err))
+	n, err := m.PartitionCount("orders")
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), n)
+	payments, err := m.Partitions("payments")
+	require.NoError(t, err)
+	again, err := m.Partitions("payments")
+	require.NoError(t, err)
+	require.Equal(t, payments, again)
+
+	// deleting a topic forgets the offsets groups committed for it.
+	require.NoError(t, m.Offsets().Commit("billing", "orders", 0, 1))
+	require.NoError(t, m.DeleteTopic("orders"))
+	_, err = m.Offsets().Fetch("billing", "orders", 0)
+	require.Equal(t, api.ErrOffsetNotCommitted{Group: "billing", Topic: "orders", Partition: 0}, err)
+	_, err = os.Stat(path.Join(dir, "orders"))
+	require.True(t, os.IsNotExist(err))
+	_, err = orders.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, api.ErrLogClosed{}, err)
+	require.Equal(t, api.ErrTopicNotFound{Topic: "orders"}, m.DeleteTopic("orders"))
+}
+
+// TestLogManagerPartitions tests that the manager routes records with the same key to
+// the same partition, and spreads records without a key over the partitions.
+func TestLogManagerPartitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manager-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := NewLogManager(dir, ManagerConfig{})
+	require.NoError(t, err)
+	require.NoError(t, m.CreateTopic("orders", TopicConfig{Partitions: 3}))
+	partitions, err := m.Partitions("orders")
+	require.NoError(t, err)
+	require.Equal(t, 3, len(partitions))
+
+	p, l, err := m.Route("orders", []byte("customer-1"))
+	require.NoError(t, err)
+	require.Equal(t, partitions[p], l)
+	for i := 0; i < 3; i++ {
+		again, _, err := m.Route("orders", []byte("customer-1"))
+		require.NoError(t, err)
+		require.Equal(t, p, again)
+	}
+	seen := make(map[uint32]bool)
+	for i := 0; i < 3; i++ {
+		p, _, err := m.Route("orders", nil)
+		require.NoError(t, err)
+		seen[p] = true
+	}
+	require.Equal(t, 3, len(seen))
+	require.NoError(t, m.Close())
+
+	// the topic keeps its partitions across restarts.
+	m, err = NewLogManager(dir, ManagerConfig{})
+	require.NoError(t, err)
+	defer m.Close()
+	partitions, err = m.Partitions("orders")
+	require.NoError(t, err)
+	require.Equal(t, 3, len(partitions))
+	for i := range partitions {
+		_, err = os.Stat(path.Join(dir, "orders", strconv.Itoa(i)))
+		require.NoError(t, err)
+	}
+}
+
+// TestLogManagerMigrate tests that a log from before topics becomes the default topic's
+// first partition, and a topic from before partitions becomes its own first partition.
+func TestLogManagerMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manager-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.Mkdir(path.Join(dir, "orders"), 0755))
+	for _, d := range []string{dir, path.Join(dir, "orders")} {
+		l, err := NewLog(d, Config{})
+		require.NoError(t, err)
+		_, err = l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.NoError(t, l.Close())
+	}
+
+	m, err := NewLogManager(dir, ManagerConfig{})
+	require.NoError(t, err)
+	defer m.Close()
+	for _, topic := range []string{DefaultTopic, "orders"} {
+		l, err := m.Partition(topic, 0)
+		require.NoError(t, err)
+		record, err := l.Read(0)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), record.Value)
+	}
+	for _, d := range []string{dir, path.Join(dir, "orders")} {
+		_, err = os.Stat(path.Join(d, "0.store"))
+		require.True(t, os.IsNotExist(err))
+	}
+}
+
+// TestTopicConfigProto tests that a topic config survives the trip to its protobuf form and back.
+func TestTopicConfigProto(t *testing.T) {
+	want := TopicConfig{
+		MaxStoreBytes:  1024,
+		MaxIndexBytes:  512,
+		MaxRecordBytes: 64,
+		RetentionBytes: 4096,
+		RetentionAge:   time.Hour,
+		Compact:        true,
+		Partitions:     3,
+	}
+	require.Equal(t, want, TopicConfigFromProto(want.Proto()))
+	require.Equal(t, TopicConfig{}, TopicConfigFromProto(nil))
+}
@@ -0,0 +1,146 @@
+package log
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The log counts what it appends as it goes, and reports its shape (segments, sizes and
+// offsets) when the registry is scraped, reading the segments under the read lock.
+
+// logMetrics is the log's prometheus.Collector. It keeps the counters the log updates as
+// it appends, and describes the gauges it reports when it's scraped.
+type logMetrics struct {
+	log             *Log
+	appendedRecords prometheus.Counter
+	appendedBytes   prometheus.Counter
+	// gauges are the descriptions of logGauges, in the same order.
+	gauges []*prometheus.Desc
+}
+
+var _ prometheus.Collector = (*logMetrics)(nil)
+
+// logGauges are the gauges the log reports when it's scraped. The log calls fn holding the read lock.
+var logGauges = []struct {
+	name, help string
+	fn         func(l *Log) float64
+}{{
+	"proglog_log_segments",
+	"Segments in the log.",
+	func(l *Log) float64 { return float64(len(l.segments)) },
+}, {
+	"proglog_log_active_segment_fill_ratio",
+	"How full the active segment is, from 0 to 1, by whichever of its store and index is fuller.",
+	func(l *Log) float64 { return l.activeSegment.fill() },
+}, {
+	"proglog_log_store_bytes",
+	"Bytes in the log's store files.",
+	func(l *Log) float64 {
+		var n uint64
+		for _, s := range l.segments {
+			n += s.store.size
+		}
+		return float64(n)
+	},
+}, {
+	"proglog_log_index_bytes",
+	"Bytes of entries in the log's index files.",
+	func(l *Log) float64 {
+		var n uint64
+		for _, s := range l.segments {
+			n += s.index.size
+		}
+		return float64(n)
+	},
+}, {
+	"proglog_log_lowest_offset",
+	"Lowest offset in the log.",
+	func(l *Log) float64 { return float64(l.segments[0].baseOffset) },
+}, {
+	"proglog_log_highest_offset",
+	"Highest offset in the log, or -1 if the log has never had a record.",
+	func(l *Log) float64 { return float64(l.activeSegment.nextOffset) - 1 },
+}}
+
+// registerMetrics sets up the log's metrics and registers them with the registry in its
+// config. The labels are constant labels on every series, so logs sharing a registry need
+// the same label names with different values. A log we reopen replaces the metrics of the
+// one we closed. Without a registry, the log still counts, but nobody reads the counters.
+func (l *Log) registerMetrics() error {
+	// Reset sets the log up again, and keeps counting where it was.
+	if l.metrics != nil {
+		return nil
+	}
+	labels := l.Config.Metrics.Labels
+	m := &logMetrics{
+		log: l,
+		appendedRecords: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "proglog_log_appended_records_total",
+			Help:        "Records appended to the log.",
+			ConstLabels: labels,
+		}),
+		appendedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "proglog_log_appended_bytes_total",
+			Help:        "Bytes appended to the log's stores, framing included.",
+			ConstLabels: labels,
+		}),
+	}
+	for _, g := range logGauges {
+		m.gauges = append(m.gauges, prometheus.NewDesc(g.name, g.help, nil, labels))
+	}
+	if r := l.Config.Metrics.Registry; r != nil {
+		err := r.Register(m)
+		if _, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			r.Unregister(m)
+			err = r.Register(m)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	l.metrics = m
+	return nil
+}
+
+// unregisterMetrics removes the log's metrics from the registry, once the log is gone for good.
+func (l *Log) unregisterMetrics() {
+	if r := l.Config.Metrics.Registry; r != nil && l.metrics != nil {
+		r.Unregister(l.metrics)
+	}
+}
+
+// Describe sends the descriptions of the log's metrics.
+func (m *logMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.appendedRecords.Describe(ch)
+	m.appendedBytes.Describe(ch)
+	for _, desc := range m.gauges {
+		ch <- desc
+	}
+}
+
+// Collect sends the log's counters and the gauges' current values.
+func (m *logMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.appendedRecords.Collect(ch)
+	m.appendedBytes.Collect(ch)
+	values := make([]float64, len(logGauges))
+	m.log.mu.RLock()
+	for i, g := range logGauges {
+		values[i] = g.fn(m.log)
+	}
+	m.log.mu.RUnlock()
+	for i, desc := range m.gauges {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, values[i])
+	}
+}
+
+// fill returns how full the segment is, from 0 to 1, by whichever of its store and index is fuller.
+func (s *segment) fill() float64 {
+	store := float64(s.store.size) / float64(s.config.Segment.MaxStoreBytes)
+	index := float64(s.index.size) / float64(s.config.Segment.MaxIndexBytes)
+	if index > store {
+		store = index
+	}
+	if store > 1 {
+		return 1
+	}
+	return store
+}
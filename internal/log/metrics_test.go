@@ -0,0 +1,111 @@
+package log
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	r := prometheus.NewRegistry()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Metrics.Registry = r
+	c.Metrics.Labels = prometheus.Labels{"topic": "test"}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		promhttp.HandlerFor(r, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec.Body.String()
+	}
+	require.Contains(t, scrape(), `proglog_log_highest_offset{topic="test"} -1`)
+
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	_, err = log.AppendBatch([]*api.Record{
+		{Value: []byte("hello world")},
+		{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	var bytes uint64
+	for _, s := range log.segments {
+		bytes += s.store.size
+	}
+	out := scrape()
+	for _, want := range []string{
+		`proglog_log_appended_records_total{topic="test"} 3`,
+		`proglog_log_appended_bytes_total{topic="test"} ` + strconv.FormatUint(bytes, 10),
+		`proglog_log_store_bytes{topic="test"} ` + strconv.FormatUint(bytes, 10),
+		`proglog_log_index_bytes{topic="test"} 36`,
+		`proglog_log_segments{topic="test"} 2`,
+		`proglog_log_lowest_offset{topic="test"} 0`,
+		`proglog_log_highest_offset{topic="test"} 2`,
+	} {
+		require.Contains(t, out, want+"\n")
+	}
+	require.Contains(t, out, `proglog_log_active_segment_fill_ratio{topic="test"} `)
+}
+
+// TestLogManagerMetrics tests that the logs of a manager's partitions report to the same
+// registry, and that a topic's metrics go away with it.
+func TestLogManagerMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	r := prometheus.NewRegistry()
+	c := ManagerConfig{}
+	c.Log.Metrics.Registry = r
+	m, err := NewLogManager(dir, c)
+	require.NoError(t, err)
+	require.NoError(t, m.CreateTopic("orders", TopicConfig{Partitions: 2}))
+
+	count := func(topic string) int {
+		families, err := r.Gather()
+		require.NoError(t, err)
+		n := 0
+		for _, f := range families {
+			if f.GetName() != "proglog_log_segments" {
+				continue
+			}
+			for _, metric := range f.GetMetric() {
+				for _, label := range metric.GetLabel() {
+					if label.GetName() == "topic" && label.GetValue() == topic {
+						n++
+					}
+				}
+			}
+		}
+		return n
+	}
+	require.Equal(t, 2, count("orders"))
+
+	require.NoError(t, m.DeleteTopic("orders"))
+	require.Equal(t, 0, count("orders"))
+	require.NoError(t, m.CreateTopic("orders", TopicConfig{Partitions: 1}))
+	require.Equal(t, 1, count("orders"))
+	require.NoError(t, m.Close())
+
+	// logs we reopen take the place of the ones we closed.
+	m, err = NewLogManager(dir, c)
+	require.NoError(t, err)
+	defer m.Close()
+	require.Equal(t, 1, count("orders"))
+}
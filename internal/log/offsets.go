@@ -0,0 +1,158 @@
+package log
+
+import (
+	"sync"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+)
+
+// offsetsTopic is the directory, under the manager's, of the log the manager keeps the
+// consumer groups' committed offsets in. Topics can't start with "__", so it can't clash with one.
+const offsetsTopic = "__consumer_offsets"
+
+// OffsetStore keeps the offsets consumer groups commit for the partitions they consume, so a
+// consumer can pick up where its group left off after a restart. It appends every commit to
+// a compacted log, keyed by the group, topic and partition, so the log only keeps the latest
+// commit of each, and reads the log back into memory when it opens.
+type OffsetStore struct {
+	log *Log
+
+	mu      sync.RWMutex
+	offsets map[offsetKey]uint64
+}
+
+type offsetKey struct {
+	group     string
+	topic     string
+	partition uint32
+}
+
+// NewOffsetStore opens the offset store in dir. The store's log compacts, never removes
+// segments for retention, and syncs every commit, whatever the config says.
+func NewOffsetStore(dir string, c Config) (*OffsetStore, error) {
+	c.Compaction.Enabled = true
+	c.Retention.MaxBytes = 0
+	c.Retention.MaxAge = 0
+	c.Durability.Policy = SyncEveryAppend
+	l, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	s := &OffsetStore{
+		log:     l,
+		offsets: make(map[offsetKey]uint64),
+	}
+	if err = s.load(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the commits in the log, the latest for each key winning.
+func (s *OffsetStore) load() error {
+	lowest, err := s.log.LowestOffset()
+	if err != nil {
+		return err
+	}
+	it := s.log.NewIterator(lowest)
+	defer it.Close()
+	for it.Next() {
+		record := it.Record()
+		k, ok := decodeOffsetKey(record.Key)
+		if !ok {
+			continue
+		}
+		if len(record.Value) != 8 {
+			delete(s.offsets, k)
+			continue
+		}
+		s.offsets[k] = enc.Uint64(record.Value)
+	}
+	return it.Err()
+}
+
+// Commit stores the group's offset for the topic's partition: the offset of the next
+// record the group wants from it.
+func (s *OffsetStore) Commit(group, topic string, partition uint32, offset uint64) error {
+	k := offsetKey{group: group, topic: topic, partition: partition}
+	value := make([]byte, 8)
+	enc.PutUint64(value, offset)
+	// we hold the lock while we append, so the map and the log agree on the order of commits.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.log.Append(&api.Record{Key: k.encode(), Value: value}); err != nil {
+		return err
+	}
+	s.offsets[k] = offset
+	return nil
+}
+
+// Fetch returns the group's committed offset for the topic's partition, or
+// api.ErrOffsetNotCommitted if it hasn't committed one.
+func (s *OffsetStore) Fetch(group, topic string, partition uint32) (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	off, ok := s.offsets[offsetKey{group: group, topic: topic, partition: partition}]
+	if !ok {
+		return 0, api.ErrOffsetNotCommitted{Group: group, Topic: topic, Partition: partition}
+	}
+	return off, nil
+}
+
+// DeleteTopic forgets every group's offsets for the topic, so a topic created again with
+// the same name starts afresh. It appends a tombstone for each, which compaction removes
+// in time.
+func (s *OffsetStore) DeleteTopic(topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k := range s.offsets {
+		if k.topic != topic {
+			continue
+		}
+		if _, err := s.log.Append(&api.Record{Key: k.encode()}); err != nil {
+			return err
+		}
+		delete(s.offsets, k)
+	}
+	return nil
+}
+
+// Close closes the store's log.
+func (s *OffsetStore) Close() error {
+	return s.log.Close()
+}
+
+// encode returns the key as the record key: the length-prefixed group and topic, followed
+// by the partition.
+func (k offsetKey) encode() []byte {
+	b := make([]byte, 2+len(k.group)+2+len(k.topic)+4)
+	i := 0
+	for _, str := range []string{k.group, k.topic} {
+		enc.PutUint16(b[i:], uint16(len(str)))
+		i += 2 + copy(b[i+2:], str)
+	}
+	enc.PutUint32(b[i:], k.partition)
+	return b
+}
+
+// decodeOffsetKey decodes a key encode encoded, and returns false if it isn't one.
+func decodeOffsetKey(b []byte) (offsetKey, bool) {
+	var k offsetKey
+	var strs [2]string
+	for i := range strs {
+		if len(b) < 2 {
+			return k, false
+		}
+		n := int(enc.Uint16(b))
+		if len(b) < 2+n {
+			return k, false
+		}
+		strs[i], b = string(b[2:2+n]), b[2+n:]
+	}
+	if len(b) != 4 {
+		return k, false
+	}
+	k.group, k.topic, k.partition = strs[0], strs[1], enc.Uint32(b)
+	return k, true
+}
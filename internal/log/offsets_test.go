@@ -0,0 +1,75 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOffsetStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsets-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+
+	s, err := NewOffsetStore(dir, c)
+	require.NoError(t, err)
+	_, err = s.Fetch("billing", "orders", 0)
+	require.Equal(t, api.ErrOffsetNotCommitted{Group: "billing", Topic: "orders", Partition: 0}, err)
+
+	// every group has its own offset for each partition, and the latest commit wins.
+	for off := uint64(1); off <= 10; off++ {
+		require.NoError(t, s.Commit("billing", "orders", 0, off))
+	}
+	require.NoError(t, s.Commit("billing", "orders", 1, 3))
+	require.NoError(t, s.Commit("shipping", "orders", 0, 7))
+	require.NoError(t, s.Commit("billing", "payments", 0, 2))
+	want := map[offsetKey]uint64{
+		{"billing", "orders", 0}:   10,
+		{"billing", "orders", 1}:   3,
+		{"shipping", "orders", 0}:  7,
+		{"billing", "payments", 0}: 2,
+	}
+	for k, off := range want {
+		got, err := s.Fetch(k.group, k.topic, k.partition)
+		require.NoError(t, err)
+		require.Equal(t, off, got)
+	}
+
+	// compaction drops the old commits, and the offsets survive a restart.
+	compacted, err := s.log.Compact()
+	require.NoError(t, err)
+	require.NotEmpty(t, compacted)
+	require.NoError(t, s.Close())
+	s, err = NewOffsetStore(dir, c)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, want, s.offsets)
+
+	require.NoError(t, s.DeleteTopic("orders"))
+	_, err = s.Fetch("billing", "orders", 0)
+	require.Equal(t, api.ErrOffsetNotCommitted{Group: "billing", Topic: "orders", Partition: 0}, err)
+	off, err := s.Fetch("billing", "payments", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+func TestOffsetKey(t *testing.T) {
+	for _, k := range []offsetKey{
+		{"billing", "orders", 3},
+		{"", "", 0},
+		{"a\x00b", "orders", 1 << 31},
+	} {
+		got, ok := decodeOffsetKey(k.encode())
+		require.True(t, ok)
+		require.Equal(t, k, got)
+	}
+	for _, b := range [][]byte{nil, {0, 5, 'a'}, []byte("hello world")} {
+		_, ok := decodeOffsetKey(b)
+		require.False(t, ok)
+	}
+}
@@ -0,0 +1,27 @@
+package log
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+)
+
+// Partitioner picks the partition of a topic to append a record to. Records with a key go
+// to the partition the key hashes to, so every record with the same key ends up in the same
+// partition, in the order they were appended. Records without a key go to each partition in
+// turn, to spread the load.
+type Partitioner struct {
+	next uint32
+}
+
+// Partition returns the partition, out of n, for a record with the given key.
+func (p *Partitioner) Partition(key []byte, n uint32) uint32 {
+	if n <= 1 {
+		return 0
+	}
+	if len(key) == 0 {
+		return (atomic.AddUint32(&p.next, 1) - 1) % n
+	}
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32() % n
+}
@@ -0,0 +1,29 @@
+package log
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitioner(t *testing.T) {
+	var p Partitioner
+	require.Equal(t, uint32(0), p.Partition([]byte("user-1"), 1))
+
+	// records without a key go to each partition in turn.
+	for i := uint32(0); i < 8; i++ {
+		require.Equal(t, i%4, p.Partition(nil, 4))
+	}
+
+	// records with the same key always go to the same partition, and keys spread over them.
+	seen := make(map[uint32]bool)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("user-%d", i))
+		part := p.Partition(key, 4)
+		require.Less(t, part, uint32(4))
+		require.Equal(t, part, p.Partition(key, 4))
+		seen[part] = true
+	}
+	require.Len(t, seen, 4)
+}
@@ -0,0 +1,309 @@
+package log
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ReplicatorConfig configures a Replicator.
+type ReplicatorConfig struct {
+	// Leader is the address of the leader's gRPC server, and DialOptions configure the
+	// connection to it, with its credentials, for example. The replicator lists the leader's
+	// topics and consumes their partitions, so the leader has to let it.
+	Leader      string
+	DialOptions []grpc.DialOption
+	// Manager is the follower's log manager. The replicator creates the leader's topics in it,
+	// and appends the leader's records to its partitions.
+	Manager *LogManager
+	// RefreshInterval is how often the replicator checks the leader for new topics and the
+	// offsets of their partitions, and how long it waits to retry a partition that failed.
+	// Defaults to a second.
+	RefreshInterval time.Duration
+}
+
+// Replicator makes a follower's log manager a copy of a leader's. It consumes every partition
+// of the leader's topics with ConsumeStream, from the follower's next offset, and appends the
+// records with Log.AppendAt, so they keep their offsets. Since it starts from where the follower's
+// logs end, a follower that restarts catches up on what it missed, and one whose leader removed
+// those records already carries on from the leader's lowest offset.
+type Replicator struct {
+	Config ReplicatorConfig
+
+	conn   *grpc.ClientConn
+	client api.LogClient
+	logger *zap.Logger
+
+	mu       sync.Mutex
+	replicas map[replicaKey]*replica
+	close    chan struct{}
+	wg       sync.WaitGroup
+}
+
+type replicaKey struct {
+	topic     string
+	partition uint32
+}
+
+// replica is the replication of one of the leader's partitions.
+type replica struct {
+	replicaKey
+	stop chan struct{}
+
+	mu sync.Mutex
+	// lowest and next are the leader's lowest and next offsets, as far as we know, and
+	// err is what last interrupted the replication.
+	lowest, next uint64
+	err          error
+}
+
+// ReplicaStatus says how far behind the leader the follower is in one of its partitions.
+type ReplicaStatus struct {
+	Topic     string
+	Partition uint32
+	// LeaderOffset is the leader's next offset, as far as the replicator knows, NextOffset
+	// the follower's, and Lag how many offsets the follower is behind.
+	LeaderOffset uint64
+	NextOffset   uint64
+	Lag          uint64
+	// Err is what last interrupted the partition's replication, if it hasn't recovered since.
+	Err error
+}
+
+// ReplicationStatus says which leader the follower replicates, and how far behind it is.
+type ReplicationStatus struct {
+	Leader   string
+	Replicas []ReplicaStatus
+}
+
+// NewReplicator connects to the leader and starts replicating it.
+func NewReplicator(c ReplicatorConfig) (*Replicator, error) {
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = time.Second
+	}
+	conn, err := grpc.Dial(c.Leader, c.DialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	r := &Replicator{
+		Config:   c,
+		conn:     conn,
+		client:   api.NewLogClient(conn),
+		logger:   zap.L().Named("replicator").With(zap.String("leader", c.Leader)),
+		replicas: make(map[replicaKey]*replica),
+		close:    make(chan struct{}),
+	}
+	r.wg.Add(1)
+	go r.run()
+	return r, nil
+}
+
+// run refreshes the partitions to replicate every RefreshInterval until the replicator closes.
+func (r *Replicator) run() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.Config.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		if err := r.refresh(); err != nil {
+			r.logger.Warn("failed to refresh the leader's topics", zap.Error(err))
+		}
+		select {
+		case <-r.close:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh creates the leader's topics that the follower doesn't have yet, starts replicating
+// partitions we don't replicate yet and stops replicating the ones the leader doesn't have
+// anymore, and updates the leader's offsets.
+func (r *Replicator) refresh() error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.Config.RefreshInterval)
+	defer cancel()
+	// a leader that serves a single log doesn't have topics to list, just the default topic.
+	topics, err := r.client.ListTopics(ctx, &api.ListTopicsRequest{})
+	if status.Code(err) == codes.Unimplemented {
+		topics, err = &api.ListTopicsResponse{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, t := range topics.Topics {
+		err = r.Config.Manager.CreateTopic(t.Name, TopicConfigFromProto(t.Config))
+		if _, ok := err.(api.ErrTopicExists); err != nil && !ok {
+			return err
+		}
+	}
+	md, err := r.client.Metadata(ctx, &api.MetadataRequest{})
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seen := make(map[replicaKey]bool)
+	for _, t := range md.Topics {
+		for _, p := range t.Partitions {
+			k := replicaKey{topic: t.Name, partition: p.Id}
+			seen[k] = true
+			rep, ok := r.replicas[k]
+			if !ok {
+				rep = &replica{replicaKey: k, stop: make(chan struct{})}
+				r.replicas[k] = rep
+				r.wg.Add(1)
+				go r.replicate(rep)
+			}
+			rep.mu.Lock()
+			rep.lowest = p.LowestOffset
+			if p.NextOffset > rep.next {
+				rep.next = p.NextOffset
+			}
+			rep.mu.Unlock()
+		}
+	}
+	for k, rep := range r.replicas {
+		if !seen[k] {
+			close(rep.stop)
+			delete(r.replicas, k)
+		}
+	}
+	return nil
+}
+
+// replicate replicates the partition until the replicator closes or the leader doesn't have
+// the partition anymore, and retries every RefreshInterval when it fails.
+func (r *Replicator) replicate(rep *replica) {
+	defer r.wg.Done()
+	for {
+		err := r.tail(rep)
+		rep.mu.Lock()
+		rep.err = err
+		rep.mu.Unlock()
+		if err != nil {
+			r.logger.Warn(
+				"replication failed",
+				zap.String("topic", rep.topic),
+				zap.Uint32("partition", rep.partition),
+				zap.Error(err),
+			)
+		}
+		select {
+		case <-r.close:
+			return
+		case <-rep.stop:
+			return
+		case <-time.After(r.Config.RefreshInterval):
+		}
+	}
+}
+
+// tail consumes the leader's partition from where the follower's ends, and appends what it
+// gets to the follower's partition, until the stream fails or we stop. It returns nil if we stop.
+func (r *Replicator) tail(rep *replica) error {
+	l, err := r.Config.Manager.Partition(rep.topic, rep.partition)
+	if err != nil {
+		return err
+	}
+	off, err := l.NextOffset()
+	if err != nil {
+		return err
+	}
+	rep.mu.Lock()
+	// the leader removed the records before its lowest offset, so we can't have them.
+	if rep.lowest > off {
+		off = rep.lowest
+	}
+	rep.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.close:
+		case <-rep.stop:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	stream, err := r.client.ConsumeStream(ctx, &api.ConsumeRequest{
+		Topic:     rep.topic,
+		Partition: rep.partition,
+		Offset:    off,
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			if status.Code(err) == codes.Canceled && ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if err = l.AppendAt(res.Record); err != nil {
+			return err
+		}
+		rep.mu.Lock()
+		rep.err = nil
+		if res.Record.Offset+1 > rep.next {
+			rep.next = res.Record.Offset + 1
+		}
+		rep.mu.Unlock()
+	}
+}
+
+// Status returns the leader, and how far behind it the follower is in each partition,
+// sorted by topic and partition.
+func (r *Replicator) Status() ReplicationStatus {
+	r.mu.Lock()
+	replicas := make([]*replica, 0, len(r.replicas))
+	for _, rep := range r.replicas {
+		replicas = append(replicas, rep)
+	}
+	r.mu.Unlock()
+	rs := ReplicationStatus{Leader: r.Config.Leader}
+	for _, rep := range replicas {
+		s := ReplicaStatus{Topic: rep.topic, Partition: rep.partition}
+		if l, err := r.Config.Manager.Partition(rep.topic, rep.partition); err == nil {
+			s.NextOffset, _ = l.NextOffset()
+		}
+		rep.mu.Lock()
+		s.LeaderOffset, s.Err = rep.next, rep.err
+		rep.mu.Unlock()
+		if s.LeaderOffset > s.NextOffset {
+			s.Lag = s.LeaderOffset - s.NextOffset
+		}
+		rs.Replicas = append(rs.Replicas, s)
+	}
+	sort.Slice(rs.Replicas, func(i, j int) bool {
+		a, b := rs.Replicas[i], rs.Replicas[j]
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		return a.Partition < b.Partition
+	})
+	return rs
+}
+
+// Close stops replicating and closes the connection to the leader.
+func (r *Replicator) Close() error {
+	r.mu.Lock()
+	select {
+	case <-r.close:
+		r.mu.Unlock()
+		return nil
+	default:
+	}
+	close(r.close)
+	r.mu.Unlock()
+	r.wg.Wait()
+	return r.conn.Close()
+}
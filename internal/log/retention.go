@@ -0,0 +1,135 @@
+package log
+
+import (
+	"os"
+	"time"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"go.uber.org/zap"
+)
+
+// RemovedSegment describes a segment the log removed to enforce its retention policy,
+// and why it removed it.
+type RemovedSegment struct {
+	BaseOffset uint64
+	NextOffset uint64
+	Bytes      uint64
+	Reason     string
+}
+
+// EnforceRetention removes the oldest segments that the retention policy says the log
+// doesn't need to keep anymore, and returns what it removed. The log calls it in the background
+// every Retention.Interval, but you can call it yourself too.
+func (l *Log) EnforceRetention() ([]RemovedSegment, error) {
+	l.compacting.Lock()
+	defer l.compacting.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed() {
+		return nil, api.ErrLogClosed{}
+	}
+	return l.retain(time.Now())
+}
+
+// retain removes segments from the front of the log while the log is bigger than
+// Retention.MaxBytes or the oldest segment's latest record is older than Retention.MaxAge
+// (see latest).
+// We never remove the active segment, or a segment that would leave the log with fewer
+// than Retention.MinOffsets offsets. Since segments only get newer (and the log only gets smaller)
+// as we go, we stop at the first segment we keep. The caller must hold the lock.
+func (l *Log) retain(now time.Time) ([]RemovedSegment, error) {
+	var size uint64
+	for _, s := range l.segments {
+		size += s.Size()
+	}
+	var removed []RemovedSegment
+	for len(l.segments) > 1 {
+		s := l.segments[0]
+		// once we remove this segment, the log starts at the next one.
+		if l.activeSegment.nextOffset-l.segments[1].baseOffset < l.Config.Retention.MinOffsets {
+			break
+		}
+		var reason string
+		if l.Config.Retention.MaxBytes > 0 && size > l.Config.Retention.MaxBytes {
+			reason = "size"
+		} else if l.Config.Retention.MaxAge > 0 {
+			latest, err := s.latest()
+			if err != nil {
+				return removed, err
+			}
+			if latest < now.Add(-l.Config.Retention.MaxAge).UnixNano() {
+				reason = "age"
+			}
+		}
+		if reason == "" {
+			return removed, nil
+		}
+		bytes := s.Size()
+		if err := s.Remove(); err != nil {
+			return removed, err
+		}
+		l.segments = l.segments[1:]
+		size -= bytes
+		removed = append(removed, RemovedSegment{
+			BaseOffset: s.baseOffset,
+			NextOffset: s.nextOffset,
+			Bytes:      bytes,
+			Reason:     reason,
+		})
+	}
+	return removed, nil
+}
+
+// latest returns the time of the segment's latest record, in nanoseconds. Segments written
+// before we stamped records don't know it (their maxTimestamp is 0, which would make them
+// look older than any MaxAge), so for those we go by when their store file was last written to.
+func (s *segment) latest() (int64, error) {
+	if s.maxTimestamp != 0 {
+		return s.maxTimestamp, nil
+	}
+	fi, err := os.Stat(s.store.Name())
+	if err != nil {
+		return 0, err
+	}
+	return fi.ModTime().UnixNano(), nil
+}
+
+// retainEvery enforces the retention policy every interval until stop is closed,
+// and logs each segment it removes.
+func (l *Log) retainEvery(interval time.Duration, stop chan struct{}) {
+	logger := zap.L().Named("log")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		l.compacting.Lock()
+		l.mu.Lock()
+		// the log may have closed while we waited for the lock.
+		select {
+		case <-stop:
+			l.mu.Unlock()
+			l.compacting.Unlock()
+			return
+		default:
+		}
+		removed, err := l.retain(time.Now())
+		l.mu.Unlock()
+		l.compacting.Unlock()
+		for _, s := range removed {
+			logger.Info(
+				"removed segment",
+				zap.Uint64("base_offset", s.BaseOffset),
+				zap.Uint64("next_offset", s.NextOffset),
+				zap.Uint64("bytes", s.Bytes),
+				zap.String("reason", s.Reason),
+			)
+		}
+		if err != nil {
+			logger.Error("retention failed", zap.Error(err))
+		}
+	}
+}
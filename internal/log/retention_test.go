@@ -0,0 +1,182 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRetention defines a table of tests for the retention policies, each given
+// a fresh log configured by the test.
+func TestRetention(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, dir string,
+	){
+		"size removes the oldest segments": testRetentionSize,
+		"age removes old segments":         testRetentionAge,
+		"age of unstamped segments":        testRetentionAgeUnstamped,
+		"min offsets keeps segments":       testRetentionMinOffsets,
+		"never removes the active segment": testRetentionActive,
+		"runs in the background":           testRetentionBackground,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "retention-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			fn(t, dir)
+		})
+	}
+}
+
+// appendN appends n records to the log, each big enough to fill a segment
+// configured with MaxStoreBytes = 32, so every record gets its own segment.
+func appendN(t *testing.T, log *Log, n int, ts int64) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := log.Append(&api.Record{
+			Value:     []byte("hello world"),
+			Timestamp: ts,
+		})
+		require.NoError(t, err)
+	}
+}
+
+func testRetentionSize(t *testing.T, dir string) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendN(t, log, 5, 0)
+
+	// keep room for two of the five full segments. (The first record is a little
+	// smaller than the rest, since proto doesn't encode a zero offset.)
+	log.Config.Retention.MaxBytes = log.segments[1].Size() * 2
+	removed, err := log.EnforceRetention()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(removed))
+	for i, s := range removed {
+		require.Equal(t, uint64(i), s.BaseOffset)
+		require.Equal(t, uint64(i+1), s.NextOffset)
+		require.Equal(t, "size", s.Reason)
+	}
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	_, err = log.Read(2)
+	require.Error(t, err)
+	_, err = log.Read(3)
+	require.NoError(t, err)
+}
+
+func testRetentionAge(t *testing.T, dir string) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Retention.MaxAge = time.Hour
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendN(t, log, 2, time.Now().Add(-2*time.Hour).UnixNano())
+	appendN(t, log, 2, time.Now().UnixNano())
+
+	removed, err := log.EnforceRetention()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(removed))
+	require.Equal(t, "age", removed[0].Reason)
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+func testRetentionAgeUnstamped(t *testing.T, dir string) {
+	// segments written before we stamped records, one last written to two hours ago
+	// and two written to just now.
+	for i, age := range []time.Duration{2 * time.Hour, 0, 0} {
+		name := filepath.Join(dir, fmt.Sprintf("%d.store", i))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		require.NoError(t, err)
+		s, err := newStore(f)
+		require.NoError(t, err)
+		p, err := proto.Marshal(&api.Record{Value: []byte("hello world"), Offset: uint64(i)})
+		require.NoError(t, err)
+		_, _, err = s.Append(p)
+		require.NoError(t, err)
+		require.NoError(t, s.Close())
+		mtime := time.Now().Add(-age)
+		require.NoError(t, os.Chtimes(name, mtime, mtime))
+	}
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Retention.MaxAge = time.Hour
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	removed, err := log.EnforceRetention()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(removed))
+	require.Equal(t, uint64(0), removed[0].BaseOffset)
+	require.Equal(t, "age", removed[0].Reason)
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+func testRetentionMinOffsets(t *testing.T, dir string) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Retention.MaxBytes = 1
+	c.Retention.MinOffsets = 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendN(t, log, 5, 0)
+
+	removed, err := log.EnforceRetention()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(removed))
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+func testRetentionActive(t *testing.T, dir string) {
+	c := Config{}
+	c.Retention.MaxBytes = 1
+	c.Retention.MaxAge = time.Nanosecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendN(t, log, 3, 0)
+
+	removed, err := log.EnforceRetention()
+	require.NoError(t, err)
+	require.Equal(t, 0, len(removed))
+	_, err = log.Read(0)
+	require.NoError(t, err)
+}
+
+func testRetentionBackground(t *testing.T, dir string) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Retention.MaxBytes = 1
+	c.Retention.Interval = time.Millisecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendN(t, log, 3, 0)
+
+	require.Eventually(t, func() bool {
+		off, err := log.LowestOffset()
+		require.NoError(t, err)
+		return off == 3
+	}, time.Second, time.Millisecond)
+}
@@ -2,11 +2,14 @@ package log
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	api "github.com/hafizmfadli/proglog/api/v1"
+	"go.uber.org/zap"
 )
 
 // segment wraps the index and store types to coordinate operations
@@ -17,11 +20,17 @@ import (
 type segment struct {
 	store *store
 	index *index
+	timeIndex *timeIndex
 
 	// we need the next and base offsets to know what offset to append new records under
 	// and to calculate the relative offsets for the index entries
 	baseOffset, nextOffset uint64
 	config Config
+
+	// maxTimestamp is the latest timestamp of any record in the segment, and
+	// timeIndexBytes counts the bytes we've written to the store since the last time index entry.
+	maxTimestamp int64
+	timeIndexBytes uint64
 }
 
 // The log calls newSegment when it needs to add a new segment, such as when the current active segment
@@ -65,6 +74,27 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		return nil, err
 	}
 
+	// Open the time index file the same way as the store file, since we only ever append to it.
+	timeIndexFile, err := os.OpenFile(
+		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".timeindex")),
+		os.O_RDWR|os.O_CREATE|os.O_APPEND,
+		0644,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if s.timeIndex, err = newTimeIndex(timeIndexFile); err != nil {
+		return nil, err
+	}
+
+	// If the service crashed, the index may still be grown to its max size or
+	// disagree with the store, so we check it before trusting its last entry.
+	if err = s.recover(); err != nil {
+		return nil, err
+	}
+	if last, ok := s.timeIndex.Last(); ok {
+		s.maxTimestamp = last.timestamp
+	}
 
 	if off, _, err := s.index.Read(-1); err != nil {
 		// index is empty, then the next record appended to the segment
@@ -79,63 +109,317 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	return s, nil
 }
 
+// consistent returns whether the index and the store agree with each other. We only
+// look at the index's last entry: it must be the last record in the store, and its
+// relative offset must be at least the number of entries. An index that wasn't truncated
+// because the service crashed ends in zeroed entries, which fails this check.
+func (s *segment) consistent() bool {
+	if s.index.size%entWidth != 0 {
+		return false
+	}
+	if s.index.size == 0 {
+		return s.store.size == 0
+	}
+	off, pos, err := s.index.Read(-1)
+	if err != nil {
+		return false
+	}
+	// offsets only go up, though compaction leaves gaps between them.
+	if uint64(off) < s.index.size/entWidth-1 || pos >= s.store.size {
+		return false
+	}
+	n, err := s.store.Width(pos)
+	if err != nil {
+		return false
+	}
+	return pos+n == s.store.size
+}
+
+// timeConsistent returns whether the time index covers the index's last entry.
+// The segment writes a final time index entry for its last record when it closes,
+// so a time index that stops short means the service crashed, or that the segment
+// was written before we had time indexes.
+func (s *segment) timeConsistent() bool {
+	last, ok := s.timeIndex.Last()
+	off, _, err := s.index.Read(-1)
+	if err != nil {
+		return !ok
+	}
+	return ok && last.off == off
+}
+
+// recover rebuilds the index from the store when the two don't agree, which happens
+// when the service didn't shut down gracefully: the index file is left at its max size,
+// the store may have records the index never heard of (or lost buffered records the index has),
+// and the last record in the store may be torn. We scan the store from the start, drop anything
+// after the last record we can read back whole, and write an index entry for each record.
+// A corrupt record with good records after it isn't a torn write but damage, so we keep the
+// records after it and leave a gap in the offsets where it was, like compaction does.
+// We rebuild the time index in the same pass, or on its own if it's the only thing missing.
+func (s *segment) recover() error {
+	rebuildIndex := !s.consistent()
+	if !rebuildIndex && s.timeConsistent() {
+		return nil
+	}
+	before := s.index.size / entWidth
+	if rebuildIndex {
+		s.index.size = 0
+	}
+	if err := s.timeIndex.Reset(); err != nil {
+		return err
+	}
+	var last *api.Record
+	end, corrupt, err := s.store.Scan(func(pos uint64, p []byte) (bool, error) {
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return false, nil
+		}
+		rel := uint32(record.Offset - s.baseOffset)
+		if rebuildIndex {
+			if err := s.index.Write(rel, pos); err != nil {
+				return false, err
+			}
+		}
+		if err := s.indexTime(record.Timestamp, rel, uint64(len(p))); err != nil {
+			return false, err
+		}
+		last = record
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(corrupt) > 0 {
+		zap.L().Named("log").Error(
+			"skipped corrupt records",
+			zap.Uint64("base_offset", s.baseOffset),
+			zap.Uint64s("positions", corrupt),
+		)
+	}
+	if last != nil {
+		if err = s.sealTimeIndex(uint32(last.Offset - s.baseOffset)); err != nil {
+			return err
+		}
+	}
+	if !rebuildIndex {
+		return nil
+	}
+	dropped := s.store.size - end
+	if dropped > 0 {
+		if err = s.store.Truncate(end); err != nil {
+			return err
+		}
+	}
+	zap.L().Named("log").Warn(
+		"repaired segment",
+		zap.Uint64("base_offset", s.baseOffset),
+		zap.Uint64("index_entries_before", before),
+		zap.Uint64("index_entries_after", s.index.size/entWidth),
+		zap.Uint64("store_bytes_dropped", dropped),
+	)
+	return nil
+}
+
+// indexTime tracks the segment's latest timestamp and adds an entry to the time index
+// for the record at the given relative offset once we've written enough bytes to the store since
+// the last entry (and the latest timestamp has moved on). We always add an entry for the segment's first record.
+func (s *segment) indexTime(ts int64, off uint32, n uint64) error {
+	s.timeIndexBytes += n
+	if ts > s.maxTimestamp {
+		s.maxTimestamp = ts
+	}
+	last, ok := s.timeIndex.Last()
+	if ok && (s.timeIndexBytes < s.config.Segment.TimeIndexIntervalBytes ||
+		s.maxTimestamp <= last.timestamp) {
+		return nil
+	}
+	s.timeIndexBytes = 0
+	return s.timeIndex.Write(s.maxTimestamp, off)
+}
+
+// sealTimeIndex adds a time index entry for the segment's last record if the
+// time index doesn't already end with it.
+func (s *segment) sealTimeIndex(off uint32) error {
+	if last, ok := s.timeIndex.Last(); ok && last.off == off {
+		return nil
+	}
+	return s.timeIndex.Write(s.maxTimestamp, off)
+}
+
 // Append writes the record to the segment and returns the newly appended record's offset.
+// Records that don't have a timestamp yet get stamped with the time we append them.
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {	
 	cur := s.nextOffset
 	record.Offset = cur
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano()
+	}
+	if err = s.write(record); err != nil {
+		return 0, err
+	}
+	return cur, nil
+}
+
+// write writes the record to the segment under the record's own offset, which must be
+// at or after the segment's next offset, and moves the next offset past it. Append uses it
+// to write new records, and compaction uses it to copy records into a cleaned segment
+// while leaving gaps where it dropped records.
+func (s *segment) write(record *api.Record) error {
 	p, err := proto.Marshal(record)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	if max := s.config.Segment.MaxRecordBytes; max > 0 && uint64(len(p)) > max {
+		return api.ErrRecordTooLarge{Size: uint64(len(p)), Max: max}
 	}
 	// appends the data to the store
-	_, pos, err := s.store.Append(p)
+	n, pos, err := s.store.Append(p)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
 	// adds an index entry
 	if err = s.index.Write(
 		// index offsets are relative to base offset
-		uint32(s.nextOffset-uint64(s.baseOffset)),
+		uint32(record.Offset-uint64(s.baseOffset)),
 		pos,
 	); err != nil {
-		return 0, err
+		return err
 	}
-	s.nextOffset++
-	return cur, nil
+	if err = s.indexTime(
+		record.Timestamp,
+		uint32(record.Offset-uint64(s.baseOffset)),
+		n,
+	); err != nil {
+		return err
+	}
+	s.nextOffset = record.Offset + 1
+	return nil
 }
 
-// Read returns the record for the given offset.
+// Read returns the record for the given offset. If compaction removed that record,
+// Read returns the next record in the segment instead (check the record's offset), and
+// io.EOF if the segment has no records at or after the offset.
 func (s *segment) Read(off uint64) (*api.Record, error) {
 	// First, translate the absolute index into a relative offset
 	// and get associated index entry.
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	rel, pos, err := s.index.Read(s.index.Search(uint32(off - s.baseOffset)))
 	if err != nil {
 		return nil, err
 	}
+	off = s.baseOffset + uint64(rel)
 
 	// Once it has the index entry, the segment can go straight 
 	// to the record's position in the store and read the proper amount
 	// of data.
+	// A record that passed its checksum but doesn't unmarshal is as corrupt as one that didn't.
 	p, err := s.store.Read(pos)
-	if err != nil {
+	if err != nil && err != errChecksum {
 		return nil, err
 	}
 	record := &api.Record{}
-	err = proto.Unmarshal(p, record)
-	return record, err
+	if err != nil || proto.Unmarshal(p, record) != nil {
+		return nil, api.ErrCorruptRecord{
+			Offset:     off,
+			BaseOffset: s.baseOffset,
+			Position:   pos,
+		}
+	}
+	return record, nil
+}
+
+// OffsetForTime returns the offset of the segment's first record whose timestamp is
+// at or after ts, and false if the segment doesn't have one. The time index gets us close,
+// and then we read records from there until we find it.
+func (s *segment) OffsetForTime(ts int64) (uint64, bool, error) {
+	if s.index.size == 0 || s.maxTimestamp < ts {
+		return 0, false, nil
+	}
+	off := s.baseOffset
+	if entry, ok := s.timeIndex.Lookup(ts); ok {
+		off = s.baseOffset + uint64(entry.off) + 1
+	}
+	for off < s.nextOffset {
+		record, err := s.Read(off)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		if record.Timestamp >= ts {
+			return record.Offset, true, nil
+		}
+		off = record.Offset + 1
+	}
+	return 0, false, nil
 }
 
 // IsMaxed returns whether the segment has reached its max size,
 // either by writing too much to the store or the index.
 func (s *segment) IsMaxed() bool {
 	// if you wrote a small number of long logs, then you'd hit the segment bytes limit.
-	// if you wrote a lot of small logs, then you'd hit the index bytes limit.
+	// if you wrote a lot of small logs, then you'd hit the index bytes limit. The index is
+	// maxed once another entry won't fit, since MaxIndexBytes needn't be a multiple of the entry width.
 	return s.store.size >= s.config.Segment.MaxStoreBytes || 
-					s.index.size >= s.config.Segment.MaxIndexBytes
+					s.index.size+entWidth > s.config.Segment.MaxIndexBytes
 }
 
-// Remove closes the segment and removes the index and store files.
+// Size returns how many bytes the segment takes up on disk.
+func (s *segment) Size() uint64 {
+	return s.store.size + s.index.size + uint64(len(s.timeIndex.entries))*timeEntWidth
+}
+
+// segmentMark records where a segment's files ended at some point in time, so the
+// log can put the segment back the way it was if a batch fails halfway through.
+type segmentMark struct {
+	nextOffset     uint64
+	storeSize      uint64
+	indexSize      uint64
+	timeEntries    int
+	maxTimestamp   int64
+	timeIndexBytes uint64
+}
+
+// mark returns where the segment's files end right now.
+func (s *segment) mark() segmentMark {
+	return segmentMark{
+		nextOffset:     s.nextOffset,
+		storeSize:      s.store.size,
+		indexSize:      s.index.size,
+		timeEntries:    len(s.timeIndex.entries),
+		maxTimestamp:   s.maxTimestamp,
+		timeIndexBytes: s.timeIndexBytes,
+	}
+}
+
+// rewind drops every record appended to the segment since the given mark.
+func (s *segment) rewind(m segmentMark) error {
+	if err := s.store.Truncate(m.storeSize); err != nil {
+		return err
+	}
+	if err := s.timeIndex.Truncate(m.timeEntries); err != nil {
+		return err
+	}
+	s.index.size = m.indexSize
+	s.nextOffset = m.nextOffset
+	s.maxTimestamp = m.maxTimestamp
+	s.timeIndexBytes = m.timeIndexBytes
+	return nil
+}
+
+// Sync flushes the segment's store, index and time index to stable storage.
+func (s *segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+	return s.timeIndex.Sync()
+}
+
+// Remove closes the segment and removes the index, time index and store files.
 func (s *segment) Remove() error {
 	if err := s.Close(); err != nil {
 		return err
@@ -143,6 +427,9 @@ func (s *segment) Remove() error {
 	if err := os.Remove(s.index.Name()); err != nil {
 		return err
 	}
+	if err := os.Remove(s.timeIndex.Name()); err != nil {
+		return err
+	}
 	if err := os.Remove(s.store.Name()); err != nil {
 		return err
 	}
@@ -150,6 +437,14 @@ func (s *segment) Remove() error {
 }
 
 func (s *segment) Close() error {
+	if off, _, err := s.index.Read(-1); err == nil {
+		if err := s.sealTimeIndex(off); err != nil {
+			return err
+		}
+	}
+	if err := s.timeIndex.Close(); err != nil {
+		return err
+	}
 	if err := s.index.Close(); err != nil {
 		return err
 	}
@@ -1,6 +1,7 @@
 package log
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -54,4 +55,130 @@ func TestSegment(t *testing.T){
 	s, err = newSegment(dir, 16, c)
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
-}
\ No newline at end of file
+}
+
+// TestSegmentRecover tests that a segment rebuilds its index from the store when the
+// service didn't close it (so the index is still grown to its max size), and that it
+// drops a torn record from the end of the store.
+func TestSegmentRecover(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-recover-test")
+	defer os.RemoveAll(dir)
+
+	want := &api.Record{Value: []byte("hello world")}
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	for i := uint64(0); i < 3; i++ {
+		_, err := s.Append(want)
+		require.NoError(t, err)
+	}
+	// simulate a crash: the store's buffer made it to disk, followed by half
+	// of a record, but nobody truncated the index.
+	require.NoError(t, s.store.buf.Flush())
+	_, err = s.store.File.Write([]byte{0x80, 0, 0, 0, 0, 0, 0, 0x20, 0x01})
+	require.NoError(t, err)
+	size := s.store.size
+
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), s.nextOffset)
+	require.Equal(t, 3*entWidth, s.index.size)
+	require.Equal(t, size, s.store.size)
+	for i := uint64(0); i < 3; i++ {
+		got, err := s.Read(16 + i)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+
+	// the segment appends after the last whole record.
+	off, err := s.Append(want)
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), off)
+	got, err := s.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, want.Value, got.Value)
+	require.NoError(t, s.Close())
+
+	// a clean shutdown leaves nothing to repair.
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.True(t, s.consistent())
+	require.Equal(t, uint64(20), s.nextOffset)
+}
+
+// TestSegmentRecoverCorrupt tests that a segment rebuilding its index keeps the records
+// after one that was damaged in the middle of the store, and leaves a gap where it was,
+// while a damaged record at the end of the store goes like a torn one.
+func TestSegmentRecoverCorrupt(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-recover-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	var positions []uint64
+	for i := 0; i < 4; i++ {
+		_, err := s.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+		_, pos, err := s.index.Read(int64(i))
+		require.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	// simulate a crash that leaves the index grown, after bit-rot in the second record
+	// and the last one.
+	require.NoError(t, s.store.buf.Flush())
+	f, err := os.OpenFile(s.store.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	for _, i := range []int{1, 3} {
+		_, err = f.WriteAt([]byte("J"), int64(positions[i]+lenWidth+crcWidth+2))
+		require.NoError(t, err)
+	}
+	require.NoError(t, f.Close())
+
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, 2*entWidth, s.index.size)
+	require.Equal(t, positions[3], s.store.size)
+	require.Equal(t, uint64(19), s.nextOffset)
+	got, err := s.Read(16)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 0"), got.Value)
+	// the damaged record's offset reads the record after it, like a compacted one.
+	got, err = s.Read(17)
+	require.NoError(t, err)
+	require.Equal(t, uint64(18), got.Offset)
+	require.Equal(t, []byte("record 2"), got.Value)
+}
+
+// TestSegmentRecoverLostStore tests that a segment drops index entries for records
+// that never made it out of the store's buffer before a crash.
+func TestSegmentRecoverLostStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-recover-test")
+	defer os.RemoveAll(dir)
+
+	want := &api.Record{Value: []byte("hello world")}
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	_, err = s.Append(want)
+	require.NoError(t, err)
+	require.NoError(t, s.store.buf.Flush())
+	// this one stays in the buffer and is lost.
+	_, err = s.Append(want)
+	require.NoError(t, err)
+
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), s.nextOffset)
+	_, err = s.Read(1)
+	require.Error(t, err)
+}
@@ -0,0 +1,118 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/hashicorp/raft"
+)
+
+// errKeyNotFound is what the stable store returns for keys it doesn't have. Raft tells a
+// missing key apart from a failure by the error's message, so it has to be "not found".
+var errKeyNotFound = errors.New("not found")
+
+var _ raft.StableStore = (*stableStore)(nil)
+
+// stableStore is where Raft keeps its current term and who it voted for, the little state it
+// needs to survive a restart besides its log. Raft sets those a handful of times per election,
+// so the store keeps them in memory and writes every one of them to a single file, by writing
+// a temporary file, syncing it and renaming it into place, so a crash leaves either the old
+// values or the new ones.
+type stableStore struct {
+	path string
+
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+// newStableStore opens the stable store in the file at path, which it creates on the first Set.
+func newStableStore(path string) (*stableStore, error) {
+	s := &stableStore{path: path, values: make(map[string][]byte)}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &s.values); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Set sets the key's value, and returns once it's on disk.
+func (s *stableStore) Set(key, val []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[string(key)] = append([]byte(nil), val...)
+	return s.persist()
+}
+
+// Get returns the key's value, or errKeyNotFound.
+func (s *stableStore) Get(key []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, ok := s.values[string(key)]
+	if !ok {
+		return nil, errKeyNotFound
+	}
+	return append([]byte(nil), val...), nil
+}
+
+// SetUint64 sets the key's value to val.
+func (s *stableStore) SetUint64(key []byte, val uint64) error {
+	b := make([]byte, 8)
+	enc.PutUint64(b, val)
+	return s.Set(key, b)
+}
+
+// GetUint64 returns the key's value, or errKeyNotFound.
+func (s *stableStore) GetUint64(key []byte) (uint64, error) {
+	b, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != 8 {
+		return 0, errors.New("stable store value isn't a uint64")
+	}
+	return enc.Uint64(b), nil
+}
+
+// persist writes the values to the store's file. The caller must hold the lock.
+func (s *stableStore) persist() error {
+	b, err := json.Marshal(s.values)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	// the rename is only durable once the directory is.
+	dir, err := os.Open(filepath.Dir(s.path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,41 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStableStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stable-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stable")
+
+	s, err := newStableStore(path)
+	require.NoError(t, err)
+	// Raft tells a key it never set apart from a failure by the error's message.
+	_, err = s.Get([]byte("LastVoteCand"))
+	require.EqualError(t, err, "not found")
+	_, err = s.GetUint64([]byte("CurrentTerm"))
+	require.EqualError(t, err, "not found")
+
+	require.NoError(t, s.Set([]byte("LastVoteCand"), []byte("127.0.0.1:8400")))
+	require.NoError(t, s.SetUint64([]byte("CurrentTerm"), 2))
+	require.NoError(t, s.SetUint64([]byte("CurrentTerm"), 3))
+
+	// the values survive a restart.
+	s, err = newStableStore(path)
+	require.NoError(t, err)
+	val, err := s.Get([]byte("LastVoteCand"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("127.0.0.1:8400"), val)
+	term, err := s.GetUint64([]byte("CurrentTerm"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), term)
+	_, err = os.Stat(path + ".tmp")
+	require.True(t, os.IsNotExist(err))
+}
@@ -3,6 +3,9 @@ package log
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
 )
@@ -10,18 +13,46 @@ import (
 var (
 	// enc defines the encoding that we persist record sizes and index entries in
 	enc = binary.BigEndian
+
+	// crcTable is the CRC-32 table (Castagnoli polynomial) we use to checksum records.
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// errChecksum is returned by the store when a record doesn't match its checksum
+	// or its framing points past the end of the file. The segment turns it into an
+	// api.ErrCorruptRecord that tells the caller where the damage is.
+	errChecksum = errors.New("store: record checksum mismatch")
 )
 
 const (
 	// lenWidth defines the number of bytes used to store the record's length
 	lenWidth = 8
+
+	// crcWidth defines the number of bytes used to store the record's checksum
+	crcWidth = 4
+
+	// crcFlag is set in the length prefix of every record written with a checksum.
+	// Stores written before we added checksums never set this bit (nobody appends
+	// 2^63 bytes), so we use it to tell the two framings apart and keep reading old segments.
+	crcFlag uint64 = 1 << 63
 )
 
+// How it works ?
+// Each record in the store is framed as:
+//
+//	| length (8 bytes, crcFlag set) | crc32 (4 bytes) | record bytes |
+//
+// The checksum covers the length prefix and the record bytes, so a torn write or
+// bit-rot in either one is caught when we read the record back instead of blowing up
+// later when the segment unmarshals it. Old records are framed without the flag and the
+// checksum, and we return them as-is.
+
 type store struct {
 	*os.File
 	mu sync.Mutex
 	buf *bufio.Writer
 	size uint64
+	// syncs counts the store's syncs, so tests can check the durability policies.
+	syncs uint64
 }
 
 // newStore creates a store for the given file.
@@ -48,17 +79,20 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	pos = s.size
 	
 	// write the length of the record so that, when we read the record, we
-	// know how many bytes to read. Uint64 takes 8 byte, So we will add additional
-	// number of bytes written later. 
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
+	// know how many bytes to read, followed by the checksum of the length and the record.
+	// Both take a fixed number of bytes, So we will add them to the number of bytes written later.
+	header := make([]byte, lenWidth+crcWidth)
+	enc.PutUint64(header[:lenWidth], uint64(len(p))|crcFlag)
+	enc.PutUint32(header[lenWidth:], checksum(header[:lenWidth], p))
+	if _, err := s.buf.Write(header); err != nil {
 		return 0, 0, err
 	}
 	w, err := s.buf.Write(p)
 	if err != nil {
 		return 0, 0, err
 	}
-	// Add additional 8 byte
-	w += lenWidth
+	// Add additional header bytes
+	w += lenWidth + crcWidth
 	s.size += uint64(w)
 	return uint64(w), pos, nil
 }
@@ -74,18 +108,163 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 		return nil, err
 	}
 
-	// Find out how many bytes we have to read to get the whole record.
+	p, _, err := s.read(pos)
+	return p, err
+}
+
+// read returns the record stored at the given position along with the number of bytes
+// its frame takes up in the store, so callers scanning the store know where the next record starts.
+// A record that doesn't match its checksum still comes with its frame's width, so a scan can skip
+// it, while one whose frame runs past the end of the store, a torn write, comes with a width of 0.
+// The caller must hold the lock and have flushed the buffer.
+func (s *store) read(pos uint64) ([]byte, uint64, error) {
+	// Find out how many bytes we have to read to get the whole record. A header
+	// cut short by a torn write is as corrupt as a bad checksum.
+	if pos+lenWidth > s.size {
+		return nil, 0, errChecksum
+	}
 	size := make([]byte, lenWidth)
 	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
+	n := enc.Uint64(size)
+	if n&crcFlag == 0 {
+		// the record was written before we added checksums.
+		if pos+lenWidth+n > s.size {
+			return nil, 0, errChecksum
+		}
+		b := make([]byte, n)
+		if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
+			return nil, 0, err
+		}
+		return b, lenWidth + n, nil
+	}
+	n &^= crcFlag
 
-	// fetch the record
-	b := make([]byte, enc.Uint64(size))
+	// make sure the length isn't garbage before we allocate for it, a torn write
+	// at the end of the file can leave a length that points past the end of the store.
+	if pos+lenWidth+crcWidth+n > s.size {
+		return nil, 0, errChecksum
+	}
+
+	// fetch the checksum and the record together, then verify them.
+	b := make([]byte, crcWidth+n)
 	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
+		return nil, 0, err
+	}
+	if checksum(size, b[crcWidth:]) != enc.Uint32(b[:crcWidth]) {
+		return nil, lenWidth + crcWidth + n, errChecksum
+	}
+	return b[crcWidth:], lenWidth + crcWidth + n, nil
+}
+
+// readFrame reads the next record from r, framed the way the store frames records, like
+// the stores Log.Reader reads. It returns io.EOF when r ends between two records, and
+// errChecksum when it ends halfway through one or the record doesn't match its checksum.
+func readFrame(r io.Reader) ([]byte, error) {
+	size := make([]byte, lenWidth)
+	if _, err := io.ReadFull(r, size); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errChecksum
+		}
 		return nil, err
 	}
-	return b, nil
+	n := enc.Uint64(size)
+	if n&crcFlag == 0 {
+		b := make([]byte, n)
+		return b, readFrameData(r, b)
+	}
+	n &^= crcFlag
+	b := make([]byte, crcWidth+n)
+	if err := readFrameData(r, b); err != nil {
+		return nil, err
+	}
+	if checksum(size, b[crcWidth:]) != enc.Uint32(b[:crcWidth]) {
+		return nil, errChecksum
+	}
+	return b[crcWidth:], nil
+}
+
+// readFrameData reads the rest of a record's frame, after its length prefix, into b.
+func readFrameData(r io.Reader, b []byte) error {
+	_, err := io.ReadFull(r, b)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errChecksum
+	}
+	return err
+}
+
+// checksum returns the checksum of a record's length prefix and data.
+func checksum(size, p []byte) uint32 {
+	return crc32.Update(crc32.Checksum(size, crcTable), crcTable, p)
+}
+
+// Width returns the number of bytes the record at the given position takes up in the store,
+// its frame included.
+func (s *store) Width(pos uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return 0, err
+	}
+	_, n, err := s.read(pos)
+	return n, err
+}
+
+// Scan calls fn with each record in the store, in order, along with its position, and returns
+// where the valid data in the store ends. A record whose frame runs past the end of the store is
+// a torn write, and where the data ends. A record that fits but doesn't match its checksum, or that
+// fn can't make sense of (fn returns false), is corrupt: Scan skips it, returns its position in
+// corrupt, and carries on, so bit-rot in one record doesn't take the records after it along.
+// Corrupt records with no valid record after them are past the end of the data, like a torn write.
+// If fn returns an error, Scan stops and returns it.
+func (s *store) Scan(fn func(pos uint64, p []byte) (bool, error)) (end uint64, corrupt []uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = s.buf.Flush(); err != nil {
+		return 0, nil, err
+	}
+	var pos uint64
+	for pos < s.size {
+		p, n, err := s.read(pos)
+		if err == errChecksum && n == 0 {
+			break
+		}
+		if err != nil && err != errChecksum {
+			return 0, nil, err
+		}
+		ok := false
+		if err == nil {
+			if ok, err = fn(pos, p); err != nil {
+				return 0, nil, err
+			}
+		}
+		if ok {
+			end = pos + n
+		} else {
+			corrupt = append(corrupt, pos)
+		}
+		pos += n
+	}
+	for len(corrupt) > 0 && corrupt[len(corrupt)-1] >= end {
+		corrupt = corrupt[:len(corrupt)-1]
+	}
+	return end, corrupt, nil
+}
+
+// Truncate drops everything in the store from the given size onwards.
+// We use it to cut a torn record off the end of the store after a crash.
+func (s *store) Truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.size = size
+	return nil
 }
 
 // ReadAt read len(p) bytes into p beginning at the off offset in the store's file.
@@ -98,6 +277,17 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	return s.File.ReadAt(p, off)
 }
 
+// Sync flushes the buffer and commits the file's contents to stable storage.
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	s.syncs++
+	return s.File.Sync()
+}
+
 // Close persists any buffered data before closing the file.
 func (s *store) Close() error {
 	s.mu.Lock()
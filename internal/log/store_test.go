@@ -1,6 +1,8 @@
 package log
 
 import (
+	"bytes"
+	"io"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -10,7 +12,7 @@ import (
 
 var (
 	write = []byte("hello world")
-	width = uint64(len(write)) + lenWidth
+	width = uint64(len(write)) + lenWidth + crcWidth
 )
 
 func TestStoreAppendRead(t *testing.T){
@@ -54,13 +56,13 @@ func testRead(t *testing.T, s *store){
 func testReadAt(t *testing.T, s *store){
 	t.Helper()
 	for i, off := uint64(1), int64(0); i < 4; i++ {
-		b := make([]byte, lenWidth)
+		b := make([]byte, lenWidth+crcWidth)
 		n, err := s.ReadAt(b, off)
 		require.NoError(t, err)
-		require.Equal(t, lenWidth, n)
+		require.Equal(t, lenWidth+crcWidth, n)
 		off += int64(n)
 
-		size := enc.Uint64(b)
+		size := enc.Uint64(b[:lenWidth]) &^ crcFlag
 		b = make([]byte, size)
 		n, err = s.ReadAt(b, off)
 		require.NoError(t, err)
@@ -70,6 +72,85 @@ func testReadAt(t *testing.T, s *store){
 	}
 }
 
+// TestStoreChecksum tests that the store catches a record whose bytes changed
+// on disk after we wrote it, instead of handing the garbage back to the caller.
+func TestStoreChecksum(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_checksum_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.NoError(t, s.buf.Flush())
+
+	// flip a bit in the record's data
+	_, err = s.File.WriteAt([]byte{write[0] ^ 0x01}, int64(pos+lenWidth+crcWidth))
+	require.NoError(t, err)
+	_, err = s.Read(pos)
+	require.Equal(t, errChecksum, err)
+
+	// a length that points past the end of the store is corrupt too
+	_, err = s.File.WriteAt([]byte{0x80, 0, 0, 0, 0, 0, 0xff, 0xff}, int64(pos))
+	require.NoError(t, err)
+	_, err = s.Read(pos)
+	require.Equal(t, errChecksum, err)
+}
+
+// TestStoreReadLegacy tests that we can still read records framed without
+// a checksum, as written by stores from before we added them.
+func TestStoreReadLegacy(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_legacy_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	b := make([]byte, lenWidth)
+	enc.PutUint64(b, uint64(len(write)))
+	_, err = f.Write(append(b, write...))
+	require.NoError(t, err)
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	read, err := s.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+
+	// new records go after the old ones with a checksum
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	read, err = s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+}
+
+// TestStoreReadFrame tests that we can read the records back out of a copy of the store's
+// file, the way a distributed log restores a snapshot, and that a copy cut short is corrupt.
+func TestStoreReadFrame(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_read_frame_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+	b := make([]byte, s.size)
+	_, err = s.ReadAt(b, 0)
+	require.NoError(t, err)
+
+	r := bytes.NewReader(b)
+	for i := 0; i < 3; i++ {
+		read, err := readFrame(r)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+	_, err = readFrame(r)
+	require.Equal(t, io.EOF, err)
+
+	_, err = readFrame(bytes.NewReader(b[:width-1]))
+	require.Equal(t, errChecksum, err)
+}
+
 func TestStoreClose(t *testing.T){
 	f, err := ioutil.TempFile("", "store_close_test")
 	require.NoError(t, err)
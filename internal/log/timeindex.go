@@ -0,0 +1,123 @@
+package log
+
+import (
+	"io"
+	"os"
+	"sort"
+)
+
+var (
+	tsWidth      uint64 = 8
+	timeEntWidth        = tsWidth + offWidth
+)
+
+// timeIndex maps time to offsets within a segment. Each entry holds a timestamp and a
+// relative offset, and says that every record up to and including that offset has a timestamp
+// no later than the entry's. The index is sparse (the segment only adds an entry after it has written
+// a configured number of bytes to the store), so it's small enough that we keep every entry in memory
+// and only append to the file.
+type timeIndex struct {
+	file    *os.File
+	entries []timeEntry
+}
+
+type timeEntry struct {
+	timestamp int64
+	off       uint32
+}
+
+// newTimeIndex creates a time index for the given file, loading the entries
+// that already exist. A crash can leave half an entry at the end of the file, so we
+// cut the file back to its last whole entry.
+func newTimeIndex(f *os.File) (*timeIndex, error) {
+	t := &timeIndex{
+		file: f,
+	}
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	size := uint64(fi.Size())
+	if rem := size % timeEntWidth; rem != 0 {
+		size -= rem
+		if err = f.Truncate(int64(size)); err != nil {
+			return nil, err
+		}
+	}
+	b := make([]byte, size)
+	if _, err = f.ReadAt(b, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	for pos := uint64(0); pos < size; pos += timeEntWidth {
+		t.entries = append(t.entries, timeEntry{
+			timestamp: int64(enc.Uint64(b[pos : pos+tsWidth])),
+			off:       enc.Uint32(b[pos+tsWidth : pos+timeEntWidth]),
+		})
+	}
+	return t, nil
+}
+
+// Name returns the time index's file path
+func (t *timeIndex) Name() string {
+	return t.file.Name()
+}
+
+// Write appends the given timestamp and relative offset to the time index.
+func (t *timeIndex) Write(ts int64, off uint32) error {
+	b := make([]byte, timeEntWidth)
+	enc.PutUint64(b[:tsWidth], uint64(ts))
+	enc.PutUint32(b[tsWidth:], off)
+	if _, err := t.file.Write(b); err != nil {
+		return err
+	}
+	t.entries = append(t.entries, timeEntry{timestamp: ts, off: off})
+	return nil
+}
+
+// Last returns the time index's last entry, if it has one.
+func (t *timeIndex) Last() (timeEntry, bool) {
+	if len(t.entries) == 0 {
+		return timeEntry{}, false
+	}
+	return t.entries[len(t.entries)-1], true
+}
+
+// Lookup returns the last entry whose timestamp is before ts. Every record up to
+// and including that entry's offset is before ts too, so the caller can start looking
+// for ts right after it. Lookup returns false if ts is at or before the first entry.
+func (t *timeIndex) Lookup(ts int64) (timeEntry, bool) {
+	i := sort.Search(len(t.entries), func(i int) bool {
+		return t.entries[i].timestamp >= ts
+	})
+	if i == 0 {
+		return timeEntry{}, false
+	}
+	return t.entries[i-1], true
+}
+
+// Reset removes every entry from the time index so the segment can rebuild it.
+func (t *timeIndex) Reset() error {
+	return t.Truncate(0)
+}
+
+// Truncate keeps the first n entries of the time index and drops the rest.
+func (t *timeIndex) Truncate(n int) error {
+	if err := t.file.Truncate(int64(uint64(n) * timeEntWidth)); err != nil {
+		return err
+	}
+	t.entries = t.entries[:n]
+	return nil
+}
+
+// Sync flushes the time index's file to stable storage.
+func (t *timeIndex) Sync() error {
+	return t.file.Sync()
+}
+
+// Close flushes the time index's file to stable storage and closes it.
+func (t *timeIndex) Close() error {
+	if err := t.Sync(); err != nil {
+		return err
+	}
+	return t.file.Close()
+}
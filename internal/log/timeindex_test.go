@@ -0,0 +1,59 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeIndex(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "timeindex_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	idx, err := newTimeIndex(f)
+	require.NoError(t, err)
+	_, ok := idx.Last()
+	require.False(t, ok)
+	require.Equal(t, f.Name(), idx.Name())
+
+	entries := []timeEntry{
+		{timestamp: 100, off: 0},
+		{timestamp: 200, off: 4},
+		{timestamp: 300, off: 9},
+	}
+	for _, want := range entries {
+		require.NoError(t, idx.Write(want.timestamp, want.off))
+		got, ok := idx.Last()
+		require.True(t, ok)
+		require.Equal(t, want, got)
+	}
+
+	// Lookup gives us the last entry before the timestamp, so we know every
+	// record up to that entry's offset is too early.
+	_, ok = idx.Lookup(100)
+	require.False(t, ok)
+	got, ok := idx.Lookup(101)
+	require.True(t, ok)
+	require.Equal(t, entries[0], got)
+	got, ok = idx.Lookup(1000)
+	require.True(t, ok)
+	require.Equal(t, entries[2], got)
+	require.NoError(t, idx.Close())
+
+	// The time index loads its entries from the existing file, dropping half an entry
+	// left at the end by a crash.
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 1, 2})
+	require.NoError(t, err)
+	idx, err = newTimeIndex(f)
+	require.NoError(t, err)
+	require.Equal(t, entries, idx.entries)
+	require.NoError(t, idx.Reset())
+	_, ok = idx.Last()
+	require.False(t, ok)
+	require.NoError(t, idx.Close())
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/hafizmfadli/proglog/internal/auth"
+	"github.com/hafizmfadli/proglog/internal/group"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Consumer groups share the partitions of the topics they consume among their members, with
+// a group.Coordinator keeping track of who's in each group and who consumes what. Members
+// consume their partitions with ConsumeStream and commit their offsets with CommitOffset, so
+// whoever gets a partition next carries on where its last owner left off.
+
+var (
+	// errNoGroups is what the group RPCs return when the server doesn't coordinate groups.
+	errNoGroups = status.Error(codes.Unimplemented, "the server doesn't coordinate consumer groups")
+	// errNoGroupTopics is what JoinGroup returns when the member doesn't consume any topics.
+	errNoGroupTopics = status.Error(codes.InvalidArgument, "members have to consume at least one topic")
+)
+
+// JoinGroup handles the requests made by consumers to join a group. The member stays in the
+// group until the stream ends, it leaves with LeaveGroup, or it misses its heartbeats, and we send
+// it its partitions every time the group rebalances. Members may only consume topics they may consume.
+func (s *grpcServer) JoinGroup(req *api.JoinGroupRequest, stream api.Log_JoinGroupServer) error {
+	if len(req.Topics) == 0 {
+		return errNoGroupTopics
+	}
+	topics := make([]string, len(req.Topics))
+	for i, topic := range req.Topics {
+		if err := authorize(stream.Context(), s.Authorizer, topic, auth.Consume); err != nil {
+			return err
+		}
+		topics[i] = topicOrDefault(topic)
+	}
+	if s.Groups == nil {
+		return errNoGroups
+	}
+	if req.Group == "" || len(req.Group) > maxGroupBytes {
+		return errInvalidGroup
+	}
+	strategy, err := assignmentStrategy(req.Strategy)
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(req.SessionTimeoutMs) * time.Millisecond
+	membership, err := s.Groups.Join(req.Group, topics, strategy, timeout)
+	if err != nil {
+		return err
+	}
+	// the member may have left already, or timed out, which is fine.
+	defer s.Groups.Leave(req.Group, membership.ID)
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.Shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		n, err := membership.Next(ctx)
+		if err != nil {
+			if s.shuttingDown() {
+				return errShuttingDown
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if err = stream.Send(&api.GroupAssignment{
+			MemberId:   membership.ID,
+			Generation: n.Generation,
+			Assigned:   topicPartitions(n.Assigned),
+			Revoked:    topicPartitions(n.Revoked),
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+// Heartbeat handles the heartbeats members send to stay in their group. Only clients that
+// may consume the member's topics may keep it in the group, like only they may have joined it.
+func (s *grpcServer) Heartbeat(ctx context.Context, req *api.HeartbeatRequest) (*api.HeartbeatResponse, error) {
+	if s.Groups == nil {
+		return nil, errNoGroups
+	}
+	if err := s.authorizeMember(ctx, req.Group, req.MemberId); err != nil {
+		return nil, err
+	}
+	generation, err := s.Groups.Heartbeat(req.Group, req.MemberId)
+	if err != nil {
+		return nil, err
+	}
+	return &api.HeartbeatResponse{Generation: generation}, nil
+}
+
+// LeaveGroup handles the requests made by members to leave their group, so the group
+// rebalances right away instead of once the member's session times out. Like Heartbeat, it
+// takes a client that may consume the member's topics.
+func (s *grpcServer) LeaveGroup(ctx context.Context, req *api.LeaveGroupRequest) (*api.LeaveGroupResponse, error) {
+	if s.Groups == nil {
+		return nil, errNoGroups
+	}
+	if err := s.authorizeMember(ctx, req.Group, req.MemberId); err != nil {
+		return nil, err
+	}
+	if err := s.Groups.Leave(req.Group, req.MemberId); err != nil {
+		return nil, err
+	}
+	return &api.LeaveGroupResponse{}, nil
+}
+
+// authorizeMember checks the client may consume every topic the member consumes, so a
+// client that learns another's member ID can't keep the member alive or evict it.
+func (s *grpcServer) authorizeMember(ctx context.Context, group, id string) error {
+	if s.Authorizer == nil {
+		return nil
+	}
+	topics, err := s.Groups.Topics(group, id)
+	if err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		if err = authorize(ctx, s.Authorizer, topic, auth.Consume); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assignmentStrategy converts the strategy from its protobuf form.
+func assignmentStrategy(s api.AssignmentStrategy) (group.Strategy, error) {
+	switch s {
+	case api.AssignmentStrategy_RANGE:
+		return group.Range, nil
+	case api.AssignmentStrategy_ROUND_ROBIN:
+		return group.RoundRobin, nil
+	}
+	return 0, status.Errorf(codes.InvalidArgument, "unknown assignment strategy: %d", s)
+}
+
+// topicPartitions converts the assignment to its protobuf form, sorted by topic.
+func topicPartitions(a group.Assignment) []*api.TopicPartitions {
+	tps := make([]*api.TopicPartitions, 0, len(a))
+	for topic, partitions := range a {
+		tps = append(tps, &api.TopicPartitions{Topic: topic, Partitions: partitions})
+	}
+	sort.Slice(tps, func(i, j int) bool {
+		return tps[i].Topic < tps[j].Topic
+	})
+	return tps
+}
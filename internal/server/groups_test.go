@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/hafizmfadli/proglog/internal/group"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestGroups tests that members joining and leaving a group get the group's partitions
+// split among them on their streams.
+func TestGroups(t *testing.T) {
+	groups := group.NewCoordinator(group.Config{
+		Partitions: func(topic string) (uint32, error) {
+			return 4, nil
+		},
+	})
+	defer groups.Close()
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.Groups = groups
+	})
+	defer teardown()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := client.Heartbeat(ctx, &api.HeartbeatRequest{Group: "billing", MemberId: "nobody"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	stream, err := client.JoinGroup(ctx, &api.JoinGroupRequest{Group: "billing"})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	join := &api.JoinGroupRequest{
+		Group:    "billing",
+		Topics:   []string{"orders"},
+		Strategy: api.AssignmentStrategy_ROUND_ROBIN,
+	}
+	first, err := client.JoinGroup(ctx, join)
+	require.NoError(t, err)
+	a, err := first.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), a.Generation)
+	require.Equal(t, []*api.TopicPartitions{{Topic: "orders", Partitions: []uint32{0, 1, 2, 3}}}, a.Assigned)
+	require.Empty(t, a.Revoked)
+
+	// the second member takes half the first member's partitions.
+	secondCtx, leave := context.WithCancel(ctx)
+	second, err := client.JoinGroup(secondCtx, join)
+	require.NoError(t, err)
+	b, err := second.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), b.Generation)
+	require.Len(t, b.Assigned[0].Partitions, 2)
+	a, err = first.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), a.Generation)
+	require.Len(t, a.Assigned[0].Partitions, 2)
+	require.Equal(t, b.Assigned, a.Revoked)
+
+	hb, err := client.Heartbeat(ctx, &api.HeartbeatRequest{Group: "billing", MemberId: a.MemberId})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), hb.Generation)
+
+	// closing its stream takes the second member out of the group.
+	leave()
+	a, err = first.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), a.Generation)
+	require.Equal(t, []uint32{0, 1, 2, 3}, a.Assigned[0].Partitions)
+
+	_, err = client.LeaveGroup(ctx, &api.LeaveGroupRequest{Group: "billing", MemberId: a.MemberId})
+	require.NoError(t, err)
+	_, err = first.Recv()
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+// authorizerFunc is an Authorizer made of a function, for tests.
+type authorizerFunc func(subject, topic, action string) error
+
+func (f authorizerFunc) Authorize(subject, topic, action string) error {
+	return f(subject, topic, action)
+}
+
+// TestGroupsAuthorization tests that clients may only send heartbeats for, and remove,
+// members whose topics they may consume.
+func TestGroupsAuthorization(t *testing.T) {
+	groups := group.NewCoordinator(group.Config{
+		Partitions: func(topic string) (uint32, error) {
+			return 1, nil
+		},
+	})
+	defer groups.Close()
+	var denied int32
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.Groups = groups
+		c.Authorizer = authorizerFunc(func(subject, topic, action string) error {
+			if atomic.LoadInt32(&denied) == 1 {
+				return status.Errorf(codes.PermissionDenied, "%s may not %s %s", subject, action, topic)
+			}
+			return nil
+		})
+	})
+	defer teardown()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.JoinGroup(ctx, &api.JoinGroupRequest{Group: "billing", Topics: []string{"orders"}})
+	require.NoError(t, err)
+	a, err := stream.Recv()
+	require.NoError(t, err)
+
+	atomic.StoreInt32(&denied, 1)
+	_, err = client.Heartbeat(ctx, &api.HeartbeatRequest{Group: "billing", MemberId: a.MemberId})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.LeaveGroup(ctx, &api.LeaveGroupRequest{Group: "billing", MemberId: a.MemberId})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// the member is still in the group, and its own client may still remove it.
+	atomic.StoreInt32(&denied, 0)
+	_, err = client.LeaveGroup(ctx, &api.LeaveGroupRequest{Group: "billing", MemberId: a.MemberId})
+	require.NoError(t, err)
+}
+
+// testGroupsWithoutCoordinator tests that a server without a coordinator doesn't serve the group RPCs.
+func testGroupsWithoutCoordinator(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	stream, err := client.JoinGroup(ctx, &api.JoinGroupRequest{Group: "billing", Topics: []string{"orders"}})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = client.Heartbeat(ctx, &api.HeartbeatRequest{Group: "billing", MemberId: "nobody"})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
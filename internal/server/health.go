@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// The health service answers the standard grpc.health.v1 checks that load balancers and
+// orchestrators send. The server is serving while the log is open and takes writes (a closed
+// or read-only log, or a server shutting down, is not serving), or with a topic manager, while
+// the manager is open. It's the same for both the server as a whole
+// (the "" service) and the Log service. We ask the log every time rather than keep a status
+// we'd have to update, so the answer is never stale.
+
+// logServiceName is the Log service's full name, which health checks ask about.
+const logServiceName = "log.v1.Log"
+
+// healthWatchInterval is how often Watch checks whether the status changed.
+var healthWatchInterval = time.Second
+
+// writableLog is implemented by logs that can tell whether they take writes, like log.Log.
+// We consider other logs always writable.
+type writableLog interface {
+	Writable() error
+}
+
+type healthServer struct {
+	*Config
+}
+
+var _ healthpb.HealthServer = (*healthServer)(nil)
+
+// registerServices registers the health and reflection services, if the config asks for them.
+func registerServices(gsrv *grpc.Server, config *Config) {
+	if config.Health {
+		healthpb.RegisterHealthServer(gsrv, &healthServer{Config: config})
+	}
+	if config.Reflection {
+		reflection.Register(gsrv)
+	}
+}
+
+// status returns the status of the service, and false if we don't know the service.
+func (s *healthServer) status(service string) (healthpb.HealthCheckResponse_ServingStatus, bool) {
+	if service != "" && service != logServiceName {
+		return healthpb.HealthCheckResponse_SERVICE_UNKNOWN, false
+	}
+	select {
+	case <-s.Shutdown:
+		return healthpb.HealthCheckResponse_NOT_SERVING, true
+	default:
+	}
+	var l interface{} = s.CommitLog
+	if s.Topics != nil {
+		l = s.Topics
+	}
+	if l, ok := l.(writableLog); ok && l.Writable() != nil {
+		return healthpb.HealthCheckResponse_NOT_SERVING, true
+	}
+	return healthpb.HealthCheckResponse_SERVING, true
+}
+
+// Check returns the service's status, or codes.NotFound if we don't know the service.
+func (s *healthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	st, ok := s.status(req.Service)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown service: %s", req.Service)
+	}
+	return &healthpb.HealthCheckResponse{Status: st}, nil
+}
+
+// Watch sends the service's status, and then sends it again every time it changes, until
+// the client goes away. A service we don't know is SERVICE_UNKNOWN, as the protocol asks.
+// When the server starts shutting down, Watch sends NOT_SERVING and ends the stream with
+// codes.Unavailable, since load balancers keep watching for as long as we let them, and a
+// graceful stop waits for every stream to end.
+func (s *healthServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	ticker := time.NewTicker(healthWatchInterval)
+	defer ticker.Stop()
+	last := healthpb.HealthCheckResponse_ServingStatus(-1)
+	for {
+		if st, _ := s.status(req.Service); st != last {
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: st}); err != nil {
+				return err
+			}
+			last = st
+		}
+		select {
+		case <-s.Shutdown:
+			return errShuttingDown
+		default:
+		}
+		select {
+		case <-stream.Context().Done():
+			return status.Error(codes.Canceled, "stream has ended")
+		case <-s.Shutdown:
+		case <-ticker.C:
+		}
+	}
+}
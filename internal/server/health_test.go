@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hafizmfadli/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+)
+
+// TestHealth tests that the health service follows the log: serving while it takes
+// writes, not serving once it's read-only.
+func TestHealth(t *testing.T) {
+	defer func(d time.Duration) { healthWatchInterval = d }(healthWatchInterval)
+	healthWatchInterval = 10 * time.Millisecond
+
+	cc, config, teardown := setupTestConn(t, func(c *Config) {
+		c.Health = true
+	})
+	defer teardown()
+	client := healthpb.NewHealthClient(cc)
+	ctx := context.Background()
+
+	for _, service := range []string{"", logServiceName} {
+		res, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		require.NoError(t, err)
+		require.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+	}
+	_, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: logServiceName})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+
+	config.CommitLog.(*log.Log).SetReadOnly(true)
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, res.Status)
+	res, err = client.Check(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, res.Status)
+}
+
+// TestHealthShutdown tests that Watch tells the client the server is going away, and then
+// ends the stream, so the server can stop gracefully.
+func TestHealthShutdown(t *testing.T) {
+	shutdown := make(chan struct{})
+	cc, _, teardown := setupTestConn(t, func(c *Config) {
+		c.Health = true
+		c.Shutdown = shutdown
+	})
+	defer teardown()
+	client := healthpb.NewHealthClient(cc)
+
+	stream, err := client.Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+
+	close(shutdown)
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, res.Status)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+// TestServices tests that the health and reflection services are only there when the
+// config asks for them.
+func TestServices(t *testing.T) {
+	ctx := context.Background()
+	for _, enabled := range []bool{false, true} {
+		cc, _, teardown := setupTestConn(t, func(c *Config) {
+			c.Health = enabled
+			c.Reflection = enabled
+		})
+
+		_, err := healthpb.NewHealthClient(cc).Check(ctx, &healthpb.HealthCheckRequest{})
+		stream, serr := rpb.NewServerReflectionClient(cc).ServerReflectionInfo(ctx)
+		require.NoError(t, serr)
+		require.NoError(t, stream.Send(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_ListServices{},
+		}))
+		res, rerr := stream.Recv()
+		if !enabled {
+			require.Equal(t, codes.Unimplemented, status.Code(err))
+			require.Equal(t, codes.Unimplemented, status.Code(rerr))
+			teardown()
+			continue
+		}
+		require.NoError(t, err)
+		require.NoError(t, rerr)
+		var services []string
+		for _, s := range res.GetListServicesResponse().Service {
+			services = append(services, s.Name)
+		}
+		require.Contains(t, services, logServiceName)
+		require.Contains(t, services, "grpc.health.v1.Health")
+		teardown()
+	}
+}
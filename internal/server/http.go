@@ -2,10 +2,13 @@ package server
 
 import (
 	"encoding/json"
-	"errors"
 	"net/http"
 
 	"github.com/gorilla/mux"
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/hafizmfadli/proglog/internal/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // When building a JSON/HTTP Go server, each handler consists of threee steps:
@@ -18,13 +21,15 @@ import (
 // and move business logic further down the stack.
 
 
+// httpServer serves the same CommitLog as the gRPC server, so both front-ends
+// read and write the same log.
 type httpServer struct{
-	Log *Log
+	*Config
 }
 
-func newHTTPServer() *httpServer {
+func newHTTPServer(config *Config) *httpServer {
 	return &httpServer{
-		Log: NewLog(),
+		Config: config,
 	}
 }
 
@@ -35,12 +40,64 @@ func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request){
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	off, err := s.Log.Append(req.Record)
+	if err = s.authorizeTopic(r, req.Topic, auth.Produce); err != nil {
+		httpError(w, err)
+		return
+	}
+	if req.Record == nil {
+		httpError(w, errNoRecord)
+		return
+	}
+	partition, clog, err := s.route(req.Topic, req.Record.Key)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	off, err := clog.Append(req.Record.proto())
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	logOffsets(r.Context(), off)
+	res := ProduceResponse{Offset: off, Partition: partition}
+	err = json.NewEncoder(w).Encode(res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	res := ProduceResponse{Offset: off}
+}
+
+func (s *httpServer) handleProduceBatch(w http.ResponseWriter, r *http.Request){
+	var req ProduceBatchRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = s.authorizeTopic(r, req.Topic, auth.Produce); err != nil {
+		httpError(w, err)
+		return
+	}
+	records := make([]*api.Record, len(req.Records))
+	for i, record := range req.Records {
+		if record == nil {
+			httpError(w, errNoRecord)
+			return
+		}
+		records[i] = record.proto()
+	}
+	partition, clog, err := s.routeBatch(req.Topic, records)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	offsets, err := clog.AppendBatch(records)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	logOffsets(r.Context(), offsets...)
+	res := ProduceBatchResponse{Offsets: offsets, Partition: partition}
 	err = json.NewEncoder(w).Encode(res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -55,18 +112,24 @@ func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request){
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	logOffsets(r.Context(), req.Offset)
+	if err = s.authorizeTopic(r, req.Topic, auth.Consume); err != nil {
+		httpError(w, err)
+		return
+	}
+	clog, err := s.partition(req.Topic, req.Partition)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
 
-	record, err := s.Log.Read(req.Offset)
+	record, err := clog.Read(req.Offset)
 	if err != nil {
-		if errors.Is(err, ErrOffsetNotFound) {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httpError(w, err)
 		return
 	}
 	
-	res := ConsumeResponse{Record: record}
+	res := ConsumeResponse{Record: newRecord(record)}
 	err = json.NewEncoder(w).Encode(res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -74,20 +137,119 @@ func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request){
 	}
 }
 
+// authorizeTopic checks that the client may perform the action on the topic.
+func (s *httpServer) authorizeTopic(r *http.Request, topic, action string) error {
+	logTopic(r.Context(), topic)
+	return authorize(r.Context(), s.Authorizer, topic, action)
+}
+
+// httpError writes the error with the HTTP status that matches the status the gRPC
+// server returns for it, so both front-ends report errors the same way.
+func httpError(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), httpStatus(err))
+}
+
+// httpStatus returns the HTTP status for the error's gRPC status code. Errors
+// without a status are internal errors.
+func httpStatus(err error) int {
+	if _, ok := err.(api.ErrRecordTooLarge); ok {
+		return http.StatusRequestEntityTooLarge
+	}
+	switch status.Code(err) {
+	case codes.OK:
+		return http.StatusOK
+	case codes.OutOfRange, codes.NotFound:
+		return http.StatusNotFound
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.FailedPrecondition, codes.AlreadyExists:
+		return http.StatusConflict
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Record is the JSON form of a record in the log.
+type Record struct {
+	Value     []byte   `json:"value"`
+	Offset    uint64   `json:"offset"`
+	Timestamp int64    `json:"timestamp"`
+	Key       []byte   `json:"key,omitempty"`
+	Headers   []Header `json:"headers,omitempty"`
+}
+
+// Header carries metadata alongside a record's value.
+type Header struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// newRecord converts a record from the log to its JSON form.
+func newRecord(record *api.Record) Record {
+	r := Record{
+		Value:     record.Value,
+		Offset:    record.Offset,
+		Timestamp: record.Timestamp,
+		Key:       record.Key,
+	}
+	for _, h := range record.Headers {
+		r.Headers = append(r.Headers, Header{Key: h.Key, Value: h.Value})
+	}
+	return r
+}
+
+// proto converts the record to the form the log stores.
+func (r Record) proto() *api.Record {
+	record := &api.Record{
+		Value:     r.Value,
+		Timestamp: r.Timestamp,
+		Key:       r.Key,
+	}
+	for _, h := range r.Headers {
+		record.Headers = append(record.Headers, &api.Header{Key: h.Key, Value: h.Value})
+	}
+	return record
+}
+
 // ProduceRequest contains the record that the caller of our API
 // wants appended to the log.
 type ProduceRequest struct {
-	Record Record `json:"record"`
+	Record *Record `json:"record"`
+	Topic  string `json:"topic,omitempty"`
 }
 
-// ProduceResponse tells the caller what offset the log stored the records under.
+// ProduceResponse tells the caller what partition and offset the log stored the record under.
 type ProduceResponse struct {
-	Offset uint64 `json:"offset"`
+	Offset    uint64 `json:"offset"`
+	Partition uint32 `json:"partition"`
+}
+
+// ProduceBatchRequest contains the records that the caller of our API wants
+// appended to the log together.
+type ProduceBatchRequest struct {
+	Records []*Record `json:"records"`
+	Topic   string    `json:"topic,omitempty"`
+}
+
+// ProduceBatchResponse tells the caller what partition and offsets the log stored the records under.
+type ProduceBatchResponse struct {
+	Offsets   []uint64 `json:"offsets"`
+	Partition uint32   `json:"partition"`
 }
 
 // ConsumeRequest specifies which records the caller of our API wants to read.
 type ConsumeRequest struct {
-	Offset uint64 `json:"offset"`
+	Offset    uint64 `json:"offset"`
+	Topic     string `json:"topic,omitempty"`
+	Partition uint32 `json:"partition,omitempty"`
 }
 
 // ConsumeResponse to send back those records to the caller.
@@ -96,16 +258,22 @@ type ConsumeResponse struct {
 }
 
 
-// NewHTTPServer takes in an address for the server to run
+// NewHTTPServer takes in an address for the server to run and the config with the log to serve,
 // and returns an *http.Server so the user just needs to call
-// ListenAndServe() to listen for and handle incoming request.
-func NewHTTPServer(addr string) *http.Server {
-	httpsrv := newHTTPServer()
+// ListenAndServe() to listen for and handle incoming request. With a TLS config, call
+// ListenAndServeTLS("", "") instead.
+func NewHTTPServer(addr string, config *Config) *http.Server {
+	httpsrv := newHTTPServer(config)
 	r := mux.NewRouter()
 	r.HandleFunc("/", httpsrv.handleProduce).Methods("POST")
+	r.HandleFunc("/batch", httpsrv.handleProduceBatch).Methods("POST")
 	r.HandleFunc("/", httpsrv.handleConsume).Methods("GET")
+	if config.Metrics != nil {
+		r.HandleFunc("/metrics", httpsrv.handleMetrics).Methods("GET")
+	}
 	return &http.Server{
 		Addr: addr,
-		Handler: r,
+		Handler: authenticateHTTP(logHTTP(config.logger, r)),
+		TLSConfig: config.TLSConfig,
 	}
 }
\ No newline at end of file
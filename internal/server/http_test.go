@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/hafizmfadli/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHTTPServer runs each case against an HTTP server backed by a fresh log on disk.
+func TestHTTPServer(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T,
+		srv *httptest.Server,
+		clog *log.Log,
+	){
+		"produce/consume a record succeeds":      testHTTPProduceConsume,
+		"produce batch succeeds":                 testHTTPProduceBatch,
+		"consume past log boundary is not found": testHTTPConsumePastBoundary,
+		"errors map to HTTP statuses":            testHTTPErrors,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "http-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			clog, err := log.NewLog(dir, log.Config{})
+			require.NoError(t, err)
+			defer clog.Close()
+			srv := httptest.NewServer(NewHTTPServer("", &Config{CommitLog: clog}).Handler)
+			defer srv.Close()
+			fn(t, srv, clog)
+		})
+	}
+}
+
+// do sends the request body as JSON and decodes the JSON response into res,
+// returning the response's status code.
+func do(t *testing.T, method, url string, req, res interface{}) int {
+	t.Helper()
+	b, err := json.Marshal(req)
+	require.NoError(t, err)
+	r, err := http.NewRequest(method, url, bytes.NewReader(b))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(r)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(res))
+	}
+	return resp.StatusCode
+}
+
+func testHTTPProduceConsume(t *testing.T, srv *httptest.Server, clog *log.Log) {
+	want := Record{
+		Value:   []byte("hello world"),
+		Key:     []byte("user-1"),
+		Headers: []Header{{Key: "trace-id", Value: []byte("abc")}},
+	}
+	var produce ProduceResponse
+	code := do(t, "POST", srv.URL, ProduceRequest{Record: &want}, &produce)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, uint64(0), produce.Offset)
+
+	var consume ConsumeResponse
+	code = do(t, "GET", srv.URL, ConsumeRequest{Offset: produce.Offset}, &consume)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, want.Value, consume.Record.Value)
+	require.Equal(t, want.Key, consume.Record.Key)
+	require.Equal(t, want.Headers, consume.Record.Headers)
+	require.NotZero(t, consume.Record.Timestamp)
+
+	// the record is in the log on disk, where the gRPC server would read it too.
+	record, err := clog.Read(produce.Offset)
+	require.NoError(t, err)
+	require.Equal(t, want.Value, record.Value)
+}
+
+func testHTTPProduceBatch(t *testing.T, srv *httptest.Server, clog *log.Log) {
+	var produce ProduceBatchResponse
+	code := do(t, "POST", srv.URL+"/batch", ProduceBatchRequest{
+		Records: []*Record{
+			{Value: []byte("first message")},
+			{Value: []byte("second message")},
+		},
+	}, &produce)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []uint64{0, 1}, produce.Offsets)
+}
+
+func testHTTPConsumePastBoundary(t *testing.T, srv *httptest.Server, clog *log.Log) {
+	var consume ConsumeResponse
+	code := do(t, "GET", srv.URL, ConsumeRequest{Offset: 1}, &consume)
+	require.Equal(t, http.StatusNotFound, code)
+}
+
+func testHTTPErrors(t *testing.T, srv *httptest.Server, clog *log.Log) {
+	var produce ProduceResponse
+	code := do(t, "POST", srv.URL, ProduceRequest{
+		Record: &Record{Value: make([]byte, 2<<20)},
+	}, &produce)
+	require.Equal(t, http.StatusRequestEntityTooLarge, code)
+
+	code = do(t, "POST", srv.URL, ProduceRequest{}, &produce)
+	require.Equal(t, http.StatusBadRequest, code)
+	var batch ProduceBatchResponse
+	code = do(t, "POST", srv.URL+"/batch", ProduceBatchRequest{
+		Records: []*Record{{Value: []byte("hello world")}, nil},
+	}, &batch)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	// without a topic manager, the server only has the default topic.
+	code = do(t, "POST", srv.URL, ProduceRequest{
+		Record: &Record{Value: []byte("hello world")},
+		Topic:  "orders",
+	}, &produce)
+	require.Equal(t, http.StatusNotFound, code)
+
+	clog.SetReadOnly(true)
+	code = do(t, "POST", srv.URL, ProduceRequest{
+		Record: &Record{Value: []byte("hello world")},
+	}, &produce)
+	require.Equal(t, http.StatusConflict, code)
+
+	require.NoError(t, clog.Close())
+	var consume ConsumeResponse
+	code = do(t, "GET", srv.URL, ConsumeRequest{Offset: 0}, &consume)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+}
@@ -0,0 +1,342 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Every request gets an ID, which we log with the request and send back to the client, so
+// a client reporting a failed request can tell us which one it was. A client (or a proxy in
+// front of us) can send its own ID in the x-request-id metadata or header, to trace a request
+// through several services; otherwise we make one up. Handlers get the ID with RequestID, and
+// gRPC calls made with the request's context pass it on.
+//
+// The logging interceptors and middleware then log each request once it's done, as structured
+// fields: the method, the client's address and subject, how long it took, its status code and
+// the offsets it produced or consumed.
+
+// requestIDKey is the metadata key (and, in HTTP, the header) with the request's ID.
+const requestIDKey = "x-request-id"
+
+type requestIDContextKey struct{}
+
+// RequestID returns the ID of the request the context belongs to, or "" if it has none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// withRequestID returns a context with the request's ID, which it also sends with any
+// gRPC call made with it.
+func withRequestID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		id = newRequestID()
+	}
+	ctx = context.WithValue(ctx, requestIDContextKey{}, id)
+	return metadata.AppendToOutgoingContext(ctx, requestIDKey, id)
+}
+
+// newRequestID returns a random 128-bit ID in hex.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// incomingRequestID returns the request ID the gRPC client sent, if any.
+func incomingRequestID(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if ids := md.Get(requestIDKey); len(ids) > 0 {
+		return ids[0]
+	}
+	return ""
+}
+
+func unaryRequestIDInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	ctx = withRequestID(ctx, incomingRequestID(ctx))
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDKey, RequestID(ctx)))
+	return handler(ctx, req)
+}
+
+func streamRequestIDInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	ctx := withRequestID(ss.Context(), incomingRequestID(ss.Context()))
+	ss.SetHeader(metadata.Pairs(requestIDKey, RequestID(ctx)))
+	return handler(srv, &contextStream{ss, ctx})
+}
+
+// requestFields tracks the topic and partition of a request, and the first and last offsets
+// it produced or consumed.
+type requestFields struct {
+	topic        string
+	partition    uint32
+	hasPartition bool
+	first, last  uint64
+	n            int
+}
+
+// add adds the offsets.
+func (o *requestFields) add(offsets ...uint64) {
+	for _, off := range offsets {
+		if o.n == 0 {
+			o.first = off
+		}
+		o.last = off
+		o.n++
+	}
+}
+
+// addTopic adds the topic and partition in a Log request or response. A stream's
+// topic is the topic of its first request.
+func (o *requestFields) addTopic(m interface{}) {
+	if t, ok := m.(interface{ GetTopic() string }); ok && o.topic == "" {
+		o.topic = topicOrDefault(t.GetTopic())
+	}
+	if p, ok := m.(interface{ GetPartition() uint32 }); ok {
+		o.partition, o.hasPartition = p.GetPartition(), true
+	}
+}
+
+// addMessage adds the topic, partition and offsets in a Log request or response.
+func (o *requestFields) addMessage(m interface{}) {
+	o.addTopic(m)
+	switch m := m.(type) {
+	case *api.ProduceResponse:
+		o.add(m.Offset)
+	case *api.ProduceBatchResponse:
+		o.add(m.Offsets...)
+	case *api.ConsumeRequest:
+		o.add(m.Offset)
+	case *api.ConsumeResponse:
+		if m.Record != nil {
+			o.add(m.Record.Offset)
+		}
+	case *api.OffsetForTimeResponse:
+		o.add(m.Offset)
+	case *api.CommitOffsetRequest:
+		o.add(m.Offset)
+	case *api.FetchOffsetResponse:
+		o.add(m.Offset)
+	}
+}
+
+// fields returns the fields to log: the topic and partition, if any, and the offsets: offset
+// for a request with one, first_offset and last_offset for one with more.
+func (o *requestFields) fields() []zap.Field {
+	var fields []zap.Field
+	if o.topic != "" {
+		fields = append(fields, zap.String("topic", o.topic))
+	}
+	if o.hasPartition {
+		fields = append(fields, zap.Uint32("partition", o.partition))
+	}
+	switch {
+	case o.n == 0:
+		return fields
+	case o.first == o.last:
+		return append(fields, zap.Uint64("offset", o.first))
+	}
+	return append(fields, zap.Uint64("first_offset", o.first), zap.Uint64("last_offset", o.last))
+}
+
+// logger returns the logger the config says to log requests with.
+func (c *Config) logger() *zap.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return zap.L().Named("server")
+}
+
+// logRequest logs a finished request. Requests that failed because of us log as errors,
+// the rest (including those the client got wrong) as info.
+func logRequest(logger *zap.Logger, ctx context.Context, method, addr string, start time.Time, code codes.Code, fields ...zap.Field) {
+	fields = append([]zap.Field{
+		zap.String("method", method),
+		zap.String("peer", addr),
+		zap.String("subject", Subject(ctx)),
+		zap.String("request_id", RequestID(ctx)),
+		zap.Duration("duration", time.Since(start)),
+		zap.String("code", code.String()),
+	}, fields...)
+	switch code {
+	case codes.Internal, codes.Unknown, codes.DataLoss:
+		logger.Error("request", fields...)
+	default:
+		logger.Info("request", fields...)
+	}
+}
+
+// peerAddr returns the gRPC client's address.
+func peerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+func unaryLoggingInterceptor(logger func() *zap.Logger) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		start := time.Now()
+		res, err := handler(ctx, req)
+		var fields requestFields
+		fields.addMessage(req)
+		if err == nil {
+			fields.addMessage(res)
+		}
+		logRequest(logger(), ctx, info.FullMethod, peerAddr(ctx), start, status.Code(err), fields.fields()...)
+		return res, err
+	}
+}
+
+func streamLoggingInterceptor(logger func() *zap.Logger) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		start := time.Now()
+		ls := &loggingStream{ServerStream: ss}
+		err := handler(srv, ls)
+		ctx := ss.Context()
+		ls.mu.Lock()
+		fields := append(
+			ls.fields.fields(),
+			zap.Int64("messages_received", ls.received),
+			zap.Int64("messages_sent", ls.sent),
+		)
+		ls.mu.Unlock()
+		logRequest(logger(), ctx, info.FullMethod, peerAddr(ctx), start, status.Code(err), fields...)
+		return err
+	}
+}
+
+// loggingStream counts the messages on a stream and tracks the topic of the messages it receives
+// and the offsets of the messages it sends. Handlers can receive in another goroutine (ProduceStream
+// does), which may still be running when the handler returns, so we lock around the fields.
+type loggingStream struct {
+	grpc.ServerStream
+	mu             sync.Mutex
+	fields         requestFields
+	received, sent int64
+}
+
+func (s *loggingStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.mu.Lock()
+		s.received++
+		s.fields.addTopic(m)
+		s.mu.Unlock()
+	}
+	return err
+}
+
+func (s *loggingStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.mu.Lock()
+		s.sent++
+		s.fields.addMessage(m)
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// httpFieldsContextKey holds the requestFields the HTTP handlers add their topic and offsets to.
+type httpFieldsContextKey struct{}
+
+// logOffsets adds offsets the HTTP request produced or consumed to its log entry.
+func logOffsets(ctx context.Context, offsets ...uint64) {
+	if f, ok := ctx.Value(httpFieldsContextKey{}).(*requestFields); ok {
+		f.add(offsets...)
+	}
+}
+
+// logTopic adds the HTTP request's topic to its log entry.
+func logTopic(ctx context.Context, topic string) {
+	if f, ok := ctx.Value(httpFieldsContextKey{}).(*requestFields); ok {
+		f.topic = topicOrDefault(topic)
+	}
+}
+
+// statusRecorder remembers the status code the handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// logHTTP is the HTTP middleware that gives each request an ID and logs it once it's done,
+// with the same fields as the gRPC interceptors, and the HTTP status as well as the gRPC code
+// it matches. It has to run after authenticateHTTP to log the subject.
+func logHTTP(logger func() *zap.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		var fields requestFields
+		ctx := withRequestID(r.Context(), r.Header.Get(requestIDKey))
+		ctx = context.WithValue(ctx, httpFieldsContextKey{}, &fields)
+		w.Header().Set(requestIDKey, RequestID(ctx))
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		logRequest(
+			logger(), ctx, r.Method+" "+r.URL.Path, r.RemoteAddr, start, httpCode(rec.code),
+			append(fields.fields(), zap.Int("http_status", rec.code))...,
+		)
+	})
+}
+
+// httpCode returns the gRPC code that matches the HTTP status, the other way around from httpStatus.
+func httpCode(status int) codes.Code {
+	switch status {
+	case http.StatusOK:
+		return codes.OK
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return codes.InvalidArgument
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.FailedPrecondition
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	case http.StatusMethodNotAllowed:
+		return codes.Unimplemented
+	}
+	return codes.Internal
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// TestLogging tests that the servers log each request with its ID, and that the
+// config's interceptors run with the ID in their context.
+func TestLogging(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	var intercepted []string
+	client, config, teardown := setupTest(t, func(c *Config) {
+		c.Logger = zap.New(core)
+		c.UnaryInterceptors = []grpc.UnaryServerInterceptor{func(
+			ctx context.Context,
+			req interface{},
+			info *grpc.UnaryServerInfo,
+			handler grpc.UnaryHandler,
+		) (interface{}, error) {
+			intercepted = append(intercepted, RequestID(ctx))
+			return handler(ctx, req)
+		}}
+	})
+	defer teardown()
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), requestIDKey, "req-1")
+	var header metadata.MD
+	_, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: []*api.Record{
+			{Value: []byte("first message")},
+			{Value: []byte("second message")},
+		},
+	}, grpc.Header(&header))
+	require.NoError(t, err)
+	require.Equal(t, []string{"req-1"}, header.Get(requestIDKey))
+	require.Equal(t, []string{"req-1"}, intercepted)
+
+	_, err = client.Consume(context.Background(), &api.ConsumeRequest{Offset: 2})
+	require.Error(t, err)
+
+	sctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.ConsumeStream(sctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = stream.Recv()
+		require.NoError(t, err)
+	}
+	header, err = stream.Header()
+	require.NoError(t, err)
+	generated := header.Get(requestIDKey)
+	require.Len(t, generated, 1)
+	require.Len(t, generated[0], 32)
+	cancel()
+
+	srv := httptest.NewServer(NewHTTPServer("", config).Handler)
+	defer srv.Close()
+	b, err := json.Marshal(ProduceRequest{Record: &Record{Value: []byte("third message")}})
+	require.NoError(t, err)
+	req, err := http.NewRequest("POST", srv.URL, bytes.NewReader(b))
+	require.NoError(t, err)
+	req.Header.Set(requestIDKey, "req-2")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	require.Equal(t, "req-2", resp.Header.Get(requestIDKey))
+
+	// the stream logs once the server notices the client went away.
+	require.Eventually(t, func() bool {
+		return logs.FilterField(zap.String("method", "/log.v1.Log/ConsumeStream")).Len() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	entries := map[string]map[string]interface{}{}
+	for _, e := range logs.All() {
+		fields := e.ContextMap()
+		entries[fields["method"].(string)] = fields
+	}
+	batch := entries["/log.v1.Log/ProduceBatch"]
+	require.Equal(t, "req-1", batch["request_id"])
+	require.Equal(t, "OK", batch["code"])
+	require.Equal(t, uint64(0), batch["first_offset"])
+	require.Equal(t, uint64(1), batch["last_offset"])
+	require.NotEmpty(t, batch["peer"])
+
+	consume := entries["/log.v1.Log/Consume"]
+	require.Equal(t, "OutOfRange", consume["code"])
+	require.Equal(t, uint64(2), consume["offset"])
+
+	cs := entries["/log.v1.Log/ConsumeStream"]
+	require.Equal(t, generated[0], cs["request_id"])
+	require.Equal(t, int64(2), cs["messages_sent"])
+	require.Equal(t, uint64(1), cs["last_offset"])
+
+	produce := entries["POST /"]
+	require.Equal(t, "req-2", produce["request_id"])
+	require.Equal(t, "OK", produce["code"])
+	require.Equal(t, int64(200), produce["http_status"])
+	require.Equal(t, uint64(2), produce["offset"])
+}
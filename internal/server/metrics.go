@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/hafizmfadli/proglog/internal/auth"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// The metrics interceptors time every RPC and count it by method and status code. They
+// wrap the error interceptors, so the code they record is the one the client gets.
+
+const (
+	rpcDurationMetric = "proglog_rpc_duration_seconds"
+	rpcRequestsMetric = "proglog_rpc_requests_total"
+	subscribersMetric = "proglog_consume_stream_subscribers"
+)
+
+// serverMetrics are the metrics the gRPC server reports. Servers that share a registry
+// share their metrics too.
+type serverMetrics struct {
+	duration    *prometheus.HistogramVec
+	requests    *prometheus.CounterVec
+	subscribers prometheus.Gauge
+}
+
+// newServerMetrics returns the server's metrics, registered with r. Without a registry,
+// the server still counts, but nobody reads the metrics.
+func newServerMetrics(r prometheus.Registerer) (*serverMetrics, error) {
+	labels := []string{"method", "code"}
+	m := &serverMetrics{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    rpcDurationMetric,
+			Help:    "How long RPCs take, in seconds. Streams last as long as the client keeps them open.",
+			Buckets: prometheus.DefBuckets,
+		}, labels),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: rpcRequestsMetric,
+			Help: "RPCs served.",
+		}, labels),
+		subscribers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: subscribersMetric,
+			Help: "ConsumeStream RPCs in flight.",
+		}),
+	}
+	if r == nil {
+		return m, nil
+	}
+	c, err := register(r, m.duration)
+	if err != nil {
+		return nil, err
+	}
+	m.duration = c.(*prometheus.HistogramVec)
+	if c, err = register(r, m.requests); err != nil {
+		return nil, err
+	}
+	m.requests = c.(*prometheus.CounterVec)
+	if c, err = register(r, m.subscribers); err != nil {
+		return nil, err
+	}
+	m.subscribers = c.(prometheus.Gauge)
+	return m, nil
+}
+
+// register registers c with r, or returns the collector r already has in its place.
+func register(r prometheus.Registerer, c prometheus.Collector) (prometheus.Collector, error) {
+	err := r.Register(c)
+	if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+		return are.ExistingCollector, nil
+	}
+	return c, err
+}
+
+// observeRPC records an RPC to the method that took since start and ended with err.
+func (m *serverMetrics) observeRPC(method string, start time.Time, err error) {
+	code := status.Code(err).String()
+	m.duration.WithLabelValues(method, code).Observe(time.Since(start).Seconds())
+	m.requests.WithLabelValues(method, code).Inc()
+}
+
+func unaryMetricsInterceptor(m *serverMetrics) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		start := time.Now()
+		res, err := handler(ctx, req)
+		m.observeRPC(info.FullMethod, start, err)
+		return res, err
+	}
+}
+
+func streamMetricsInterceptor(m *serverMetrics) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		m.observeRPC(info.FullMethod, start, err)
+		return err
+	}
+}
+
+// handleMetrics serves the registry's metrics to clients allowed to administer every topic.
+func (s *httpServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if s.Authorizer != nil {
+		if err := s.Authorizer.Authorize(Subject(r.Context()), "", auth.Admin); err != nil {
+			httpError(w, err)
+			return
+		}
+	}
+	promhttp.HandlerFor(s.Metrics, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
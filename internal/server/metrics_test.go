@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMetrics tests that the servers count RPCs and stream subscribers, and that the
+// HTTP server serves the metrics on /metrics.
+func TestMetrics(t *testing.T) {
+	client, config, teardown := setupTest(t, func(c *Config) {
+		c.Metrics = prometheus.NewRegistry()
+	})
+	defer teardown()
+	srv := httptest.NewServer(NewHTTPServer("", config).Handler)
+	defer srv.Close()
+
+	scrape := func() string {
+		resp, err := http.Get(srv.URL + "/metrics")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		b, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.Error(t, err)
+
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	out := scrape()
+	for _, want := range []string{
+		`proglog_rpc_requests_total{code="OK",method="/log.v1.Log/Produce"} 1`,
+		`proglog_rpc_requests_total{code="OutOfRange",method="/log.v1.Log/Consume"} 1`,
+		`proglog_rpc_duration_seconds_count{code="OK",method="/log.v1.Log/Produce"} 1`,
+		`proglog_consume_stream_subscribers 1`,
+	} {
+		require.Contains(t, out, want+"\n")
+	}
+
+	cancel()
+	require.Eventually(t, func() bool {
+		return strings.Contains(scrape(), "proglog_consume_stream_subscribers 0\n")
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/hafizmfadli/proglog/internal/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Consumer groups commit the offset of the next record they want from each partition they
+// consume, and the server keeps it for them, so a consumer that restarts (or another member
+// of its group) carries on where the group left off instead of replaying or skipping records.
+
+// OffsetStore keeps the offsets consumer groups commit. log.OffsetStore implements it, and
+// log.LogManager keeps one alongside its topics.
+type OffsetStore interface {
+	Commit(group, topic string, partition uint32, offset uint64) error
+	// Fetch returns the group's committed offset, or api.ErrOffsetNotCommitted.
+	Fetch(group, topic string, partition uint32) (uint64, error)
+}
+
+// maxGroupBytes is the longest group name the server accepts.
+const maxGroupBytes = 255
+
+var (
+	// errNoOffsets is what the offset RPCs return when the server doesn't have an offset store.
+	errNoOffsets = status.Error(codes.Unimplemented, "the server doesn't store offsets")
+	// errInvalidGroup is what the offset RPCs return for a missing or too long group.
+	errInvalidGroup = status.Error(codes.InvalidArgument, "group must have between 1 and 255 bytes")
+)
+
+// CommitOffset handles the requests made by consumers to commit their group's offset for a
+// partition. Groups may only commit offsets for topics they may consume, and partitions that exist.
+func (s *grpcServer) CommitOffset(ctx context.Context, req *api.CommitOffsetRequest) (*api.CommitOffsetResponse, error) {
+	if err := s.checkOffsetRequest(ctx, req.Group, req.Topic, req.Partition); err != nil {
+		return nil, err
+	}
+	if err := s.Offsets.Commit(req.Group, topicOrDefault(req.Topic), req.Partition, req.Offset); err != nil {
+		return nil, err
+	}
+	return &api.CommitOffsetResponse{}, nil
+}
+
+// FetchOffset handles the requests made by consumers to find where their group left off in a partition.
+func (s *grpcServer) FetchOffset(ctx context.Context, req *api.FetchOffsetRequest) (*api.FetchOffsetResponse, error) {
+	if err := s.checkOffsetRequest(ctx, req.Group, req.Topic, req.Partition); err != nil {
+		return nil, err
+	}
+	offset, err := s.Offsets.Fetch(req.Group, topicOrDefault(req.Topic), req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	return &api.FetchOffsetResponse{Offset: offset}, nil
+}
+
+// checkOffsetRequest checks that the client may consume the topic, that the server stores
+// offsets, and that the group and partition are valid.
+func (s *grpcServer) checkOffsetRequest(ctx context.Context, group, topic string, partition uint32) error {
+	if err := authorize(ctx, s.Authorizer, topic, auth.Consume); err != nil {
+		return err
+	}
+	if s.Offsets == nil {
+		return errNoOffsets
+	}
+	if group == "" || len(group) > maxGroupBytes {
+		return errInvalidGroup
+	}
+	_, err := s.partition(topic, partition)
+	return err
+}
+
+// startOffset returns the offset a consume stream starts at: the group's committed offset,
+// if the request names a group that committed one, and the request's offset otherwise.
+func (c *Config) startOffset(req *api.ConsumeRequest) (uint64, error) {
+	if req.Group == "" {
+		return req.Offset, nil
+	}
+	if c.Offsets == nil {
+		return 0, errNoOffsets
+	}
+	off, err := c.Offsets.Fetch(req.Group, topicOrDefault(req.Topic), req.Partition)
+	if _, ok := err.(api.ErrOffsetNotCommitted); ok {
+		return req.Offset, nil
+	}
+	return off, err
+}
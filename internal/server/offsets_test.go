@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/hafizmfadli/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestOffsets tests that consumer groups can commit and fetch their offsets, and that
+// ConsumeStream starts from a group's committed offset.
+func TestOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsets-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	m, err := log.NewLogManager(dir, log.ManagerConfig{})
+	require.NoError(t, err)
+	defer m.Close()
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.Topics = NewTopicManager(m)
+		c.Offsets = m.Offsets()
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	for _, value := range []string{"first", "second", "third"} {
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value)},
+		})
+		require.NoError(t, err)
+	}
+
+	_, err = client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "billing"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "billing", Offset: 2})
+	require.NoError(t, err)
+	fetch, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "billing", Topic: log.DefaultTopic})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), fetch.Offset)
+
+	for _, tc := range []struct {
+		req  *api.CommitOffsetRequest
+		code codes.Code
+	}{
+		{&api.CommitOffsetRequest{}, codes.InvalidArgument},
+		{&api.CommitOffsetRequest{Group: "billing", Partition: 1}, codes.NotFound},
+		{&api.CommitOffsetRequest{Group: "billing", Topic: "orders"}, codes.NotFound},
+	} {
+		_, err = client.CommitOffset(ctx, tc.req)
+		require.Equal(t, tc.code, status.Code(err))
+	}
+
+	// a group that committed an offset starts there, and one that didn't starts at the request's offset.
+	for group, want := range map[string]string{"billing": "third", "shipping": "second"} {
+		stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Group: group, Offset: 1})
+		require.NoError(t, err)
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, []byte(want), res.Record.Value)
+	}
+}
+
+// testOffsetsWithoutStore tests that a server without an offset store doesn't serve the offset RPCs.
+func testOffsetsWithoutStore(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "billing"})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Group: "billing"})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/hafizmfadli/proglog/internal/auth"
+)
+
+// A follower serves reads of a copy of its leader's topics, kept up to date by a
+// log.Replicator, which appends the leader's records to the follower's read-only partitions
+// under the same offsets. Clients produce to the leader, and may consume from either.
+
+// ReplicationStatus handles the requests made by admins to find out how far behind its leader
+// the server is. A server that doesn't follow a leader returns an empty status.
+func (s *grpcServer) ReplicationStatus(ctx context.Context, req *api.ReplicationStatusRequest) (*api.ReplicationStatusResponse, error) {
+	if s.Authorizer != nil {
+		if err := s.Authorizer.Authorize(Subject(ctx), "", auth.Admin); err != nil {
+			return nil, err
+		}
+	}
+	res := &api.ReplicationStatusResponse{}
+	if s.Replicator == nil {
+		return res, nil
+	}
+	rs := s.Replicator.Status()
+	res.Leader = rs.Leader
+	for _, r := range rs.Replicas {
+		replica := &api.ReplicaStatus{
+			Topic:        r.Topic,
+			Partition:    r.Partition,
+			LeaderOffset: r.LeaderOffset,
+			NextOffset:   r.NextOffset,
+			Lag:          r.Lag,
+		}
+		if r.Err != nil {
+			replica.Error = r.Err.Error()
+		}
+		res.Replicas = append(res.Replicas, replica)
+	}
+	return res, nil
+}
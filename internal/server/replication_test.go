@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/hafizmfadli/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestReplication tests that a follower replicates its leader's topics, under the same
+// offsets, reports its lag, and catches up on what it missed when its replicator restarts.
+func TestReplication(t *testing.T) {
+	leaderDir, err := ioutil.TempDir("", "replication-test-leader")
+	require.NoError(t, err)
+	defer os.RemoveAll(leaderDir)
+	followerDir, err := ioutil.TempDir("", "replication-test-follower")
+	require.NoError(t, err)
+	defer os.RemoveAll(followerDir)
+
+	leaderTopics, err := log.NewLogManager(leaderDir, log.ManagerConfig{})
+	require.NoError(t, err)
+	defer leaderTopics.Close()
+	leaderConn, _, leaderTeardown := setupTestConn(t, func(c *Config) {
+		c.Topics = NewTopicManager(leaderTopics)
+	})
+	defer leaderTeardown()
+	leader := api.NewLogClient(leaderConn)
+
+	followerTopics, err := log.NewLogManager(followerDir, log.ManagerConfig{ReadOnly: true})
+	require.NoError(t, err)
+	defer followerTopics.Close()
+	newReplicator := func() *log.Replicator {
+		r, err := log.NewReplicator(log.ReplicatorConfig{
+			Leader:          leaderConn.Target(),
+			DialOptions:     []grpc.DialOption{grpc.WithInsecure()},
+			Manager:         followerTopics,
+			RefreshInterval: 50 * time.Millisecond,
+		})
+		require.NoError(t, err)
+		return r
+	}
+	replicator := newReplicator()
+	var cfg *Config
+	follower, cfg, followerTeardown := setupTest(t, func(c *Config) {
+		c.Topics = NewTopicManager(followerTopics)
+		c.Replicator = replicator
+	})
+	defer followerTeardown()
+	ctx := context.Background()
+
+	_, err = leader.CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic:  "orders",
+		Config: &api.TopicConfig{Partitions: 2},
+	})
+	require.NoError(t, err)
+	produce := func(n int) {
+		for i := 0; i < n; i++ {
+			for _, topic := range []string{"", "orders"} {
+				_, err := leader.Produce(ctx, &api.ProduceRequest{
+					Record: &api.Record{Key: []byte(fmt.Sprint(i)), Value: []byte(fmt.Sprintf("record %d", i))},
+					Topic:  topic,
+				})
+				require.NoError(t, err)
+			}
+		}
+	}
+	// caughtUp returns whether the follower has every record of every partition of the leader's,
+	// and whether its status says so.
+	caughtUp := func() bool {
+		md, err := leader.Metadata(ctx, &api.MetadataRequest{})
+		require.NoError(t, err)
+		res, err := follower.ReplicationStatus(ctx, &api.ReplicationStatusRequest{})
+		require.NoError(t, err)
+		var partitions int
+		for _, topic := range md.Topics {
+			for _, p := range topic.Partitions {
+				partitions++
+				l, err := followerTopics.Partition(topic.Name, p.Id)
+				if err != nil {
+					return false
+				}
+				if next, _ := l.NextOffset(); next != p.NextOffset {
+					return false
+				}
+			}
+		}
+		if len(res.Replicas) != partitions {
+			return false
+		}
+		for _, r := range res.Replicas {
+			if r.Lag != 0 || r.Error != "" {
+				return false
+			}
+		}
+		return true
+	}
+
+	produce(5)
+	require.Eventually(t, caughtUp, 5*time.Second, 10*time.Millisecond)
+	res, err := follower.ReplicationStatus(ctx, &api.ReplicationStatusRequest{})
+	require.NoError(t, err)
+	require.Equal(t, leaderConn.Target(), res.Leader)
+	require.Equal(t, 3, len(res.Replicas))
+	require.Equal(t, log.DefaultTopic, res.Replicas[0].Topic)
+	require.Equal(t, uint64(5), res.Replicas[0].NextOffset)
+
+	// the follower's records have the leader's offsets, and it doesn't take writes of its own.
+	for off := uint64(0); off < 5; off++ {
+		want, err := leader.Consume(ctx, &api.ConsumeRequest{Offset: off})
+		require.NoError(t, err)
+		got, err := follower.Consume(ctx, &api.ConsumeRequest{Offset: off})
+		require.NoError(t, err)
+		require.Equal(t, want.Record.Value, got.Record.Value)
+		require.Equal(t, off, got.Record.Offset)
+	}
+	_, err = follower.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// a replicator that restarts carries on from where the follower's partitions end.
+	require.NoError(t, replicator.Close())
+	produce(5)
+	cfg.Replicator = newReplicator()
+	defer cfg.Replicator.Close()
+	require.Eventually(t, caughtUp, 5*time.Second, 10*time.Millisecond)
+	got, err := follower.Consume(ctx, &api.ConsumeRequest{Offset: 9})
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 4"), got.Record.Value)
+}
+
+// testReplicationWithoutReplicator tests that a server that doesn't follow a leader returns
+// an empty replication status.
+func testReplicationWithoutReplicator(t *testing.T, client api.LogClient, config *Config) {
+	res, err := client.ReplicationStatus(context.Background(), &api.ReplicationStatusRequest{})
+	require.NoError(t, err)
+	require.Equal(t, "", res.Leader)
+	require.Equal(t, 0, len(res.Replicas))
+}
@@ -2,33 +2,142 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"io"
+	"time"
 
 	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/hafizmfadli/proglog/internal/auth"
+	"github.com/hafizmfadli/proglog/internal/group"
+	"github.com/hafizmfadli/proglog/internal/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 )
 
 type Config struct {
+	// CommitLog is the log the servers serve the default topic from, when they don't
+	// have a TopicManager.
 	CommitLog CommitLog
+	// Topics, when set, gives the servers the log of each topic, and lets admins create
+	// and delete topics.
+	Topics TopicManager
+	// Offsets, when set, keeps the offsets consumer groups commit, and lets ConsumeStream
+	// start from a group's committed offset.
+	Offsets OffsetStore
+	// Groups, when set, coordinates consumer groups, which share the partitions of the
+	// topics they consume among their members.
+	Groups *group.Coordinator
+	// Replicator, when set, is what keeps this server, a follower, a copy of its leader, and
+	// ReplicationStatus reports how far behind the leader it is.
+	Replicator *log.Replicator
+	// Shutdown, once closed, ends the streaming RPCs with codes.Unavailable, so a server
+	// shutting down gracefully doesn't wait on streams that never end by themselves.
+	Shutdown <-chan struct{}
+	// TLSConfig, when set, makes the servers serve over TLS. Build it with config.SetupTLSConfig;
+	// with a CA, it requires and verifies client certificates, and handlers get the client's subject
+	// with Subject.
+	TLSConfig *tls.Config
+	// Authorizer, when set, decides what each client may do, by the subject of its
+	// certificate. Without one, every client may do everything.
+	Authorizer Authorizer
+	// Metrics, when set, is where the servers report their metrics, and the HTTP server
+	// serves it on /metrics in the Prometheus text format. Give the log the same registry
+	// to serve the log's metrics along with the servers'.
+	Metrics *prometheus.Registry
+	// Health registers the standard gRPC health service (grpc.health.v1.Health), which says
+	// the server is serving while the log (or the topic manager) is open and takes writes.
+	Health bool
+	// Reflection registers the gRPC reflection service, so tools like grpcurl can find and
+	// call the Log service without its proto files.
+	Reflection bool
+	// Logger is what the servers log requests with. Defaults to the global logger, named "server".
+	Logger *zap.Logger
+	// UnaryInterceptors and StreamInterceptors run, in order, after the server's own interceptors,
+	// so they see the request's ID and the client's subject, and right before the handler.
+	UnaryInterceptors  []grpc.UnaryServerInterceptor
+	StreamInterceptors []grpc.StreamServerInterceptor
+}
+
+// Authorizer decides whether a subject may perform an action (auth.Produce, auth.Consume
+// or auth.Admin) on a topic. It returns a codes.PermissionDenied error when it may not.
+// auth.Authorizer implements it with a policy file.
+type Authorizer interface {
+	Authorize(subject, topic, action string) error
+}
+
+// authorize checks with the authorizer, if any, that the client may perform the action
+// on the topic. An empty topic is the default topic.
+func authorize(ctx context.Context, a Authorizer, topic, action string) error {
+	if a == nil {
+		return nil
+	}
+	return a.Authorize(Subject(ctx), topicOrDefault(topic), action)
+}
+
+// errShuttingDown is the status the streaming RPCs end with when the server shuts down.
+// Clients can retry against another server, or this one once it's back.
+var errShuttingDown = status.Error(codes.Unavailable, "server is shutting down")
+
+// errNoRecord is what produce requests get when they're missing a record, or a batch has
+// a nil one.
+var errNoRecord = status.Error(codes.InvalidArgument, "produce requests need a record")
+
+// checkRecords returns errNoRecord if any of the records is nil, which the log can't append.
+func checkRecords(records ...*api.Record) error {
+	for _, record := range records {
+		if record == nil {
+			return errNoRecord
+		}
+	}
+	return nil
 }
 
 var _ api.LogServer = (*grpcServer)(nil)
 
 // NewGRPCServer to provide a way to instantiate your service, create a gRPC server,
 // and register your service to that server (this will give the user a server 
-// that just needs a listener for it to accept incoming connections)
-func NewGRPCServer(config *Config) (*grpc.Server, error) {
-	gsrv := grpc.NewServer()
+// that just needs a listener for it to accept incoming connections). The options
+// configure the gRPC server, with its credentials, for example.
+func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, error) {
 	srv, err := newgrpcServer(config)
 	if err != nil {
 		return nil, err
 	}
+	// the metrics and logging interceptors wrap the error interceptors so they see the codes
+	// clients get, and the request ID and subject come first so they can log them.
+	unary := []grpc.UnaryServerInterceptor{unaryRequestIDInterceptor, unaryAuthenticateInterceptor}
+	stream := []grpc.StreamServerInterceptor{streamRequestIDInterceptor, streamAuthenticateInterceptor}
+	if config.Metrics != nil {
+		unary = append(unary, unaryMetricsInterceptor(srv.metrics))
+		stream = append(stream, streamMetricsInterceptor(srv.metrics))
+	}
+	unary = append(unary, unaryLoggingInterceptor(config.logger), unaryErrorInterceptor)
+	stream = append(stream, streamLoggingInterceptor(config.logger), streamErrorInterceptor)
+	unary = append(unary, config.UnaryInterceptors...)
+	stream = append(stream, config.StreamInterceptors...)
+	serverOpts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
+	}
+	if config.TLSConfig != nil {
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(config.TLSConfig)))
+	}
+	opts = append(serverOpts, opts...)
+	gsrv := grpc.NewServer(opts...)
 	api.RegisterLogServer(gsrv, srv)
+	registerServices(gsrv, config)
 	return gsrv, nil
 }
 
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*Config
+	// metrics times and counts the RPCs, and counts the ConsumeStream RPCs in flight.
+	metrics *serverMetrics
 }
 
 // CommitLog interface enable our service weren't tied to a specific log implementation.
@@ -38,43 +147,151 @@ type grpcServer struct {
 // that satifies the log interface. (Dependency Inversion with Interfaces)
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
+	AppendBatch([]*api.Record) ([]uint64, error)
 	Read(uint64) (*api.Record, error)
+	OffsetForTime(time.Time) (uint64, error)
+	Wait(context.Context, uint64) error
+	NewIterator(uint64) *log.Iterator
+	LowestOffset() (uint64, error)
+	NextOffset() (uint64, error)
 }
 
+var (
+	_ CommitLog = (*log.Log)(nil)
+	_ CommitLog = (*log.DistributedLog)(nil)
+)
+
 func newgrpcServer(config *Config) (srv *grpcServer, err error) {
-	srv = &grpcServer{
-		Config: config,
+	srv = &grpcServer{Config: config}
+	// a nil *prometheus.Registry isn't a nil prometheus.Registerer.
+	var r prometheus.Registerer
+	if config.Metrics != nil {
+		r = config.Metrics
+	}
+	if srv.metrics, err = newServerMetrics(r); err != nil {
+		return nil, err
 	}
 	return srv, nil
 }
 
-// Produce handles the requests made by clients to produce
+// Produce handles the requests made by clients to produce. The log's Append doesn't return
+// until the record is as durable as the log's durability policy promises, so neither do we.
+// The record goes to the partition its key hashes to, or to each partition in turn without a key.
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error){
-	offset, err := s.CommitLog.Append(req.Record)
+	if err := authorize(ctx, s.Authorizer, req.Topic, auth.Produce); err != nil {
+		return nil, err
+	}
+	if err := checkRecords(req.Record); err != nil {
+		return nil, err
+	}
+	partition, clog, err := s.route(req.Topic, req.Record.GetKey())
+	if err != nil {
+		return nil, err
+	}
+	offset, err := clog.Append(req.Record)
 	if err != nil {
 		return nil, err
 	}
-	return &api.ProduceResponse{Offset: offset}, nil
+	return &api.ProduceResponse{Offset: offset, Partition: partition}, nil
+}
+
+// ProduceBatch handles the requests made by clients to produce several records at once.
+// Either every record in the batch makes it into the log, under contiguous offsets, or none do,
+// so the whole batch goes to a single partition, the one its records' keys pick (see routeBatch).
+func (s *grpcServer) ProduceBatch(ctx context.Context, req *api.ProduceBatchRequest) (*api.ProduceBatchResponse, error) {
+	if err := authorize(ctx, s.Authorizer, req.Topic, auth.Produce); err != nil {
+		return nil, err
+	}
+	if err := checkRecords(req.Records...); err != nil {
+		return nil, err
+	}
+	partition, clog, err := s.routeBatch(req.Topic, req.Records)
+	if err != nil {
+		return nil, err
+	}
+	offsets, err := clog.AppendBatch(req.Records)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ProduceBatchResponse{Offsets: offsets, Partition: partition}, nil
 }
 
 // Consume handles the request made by clients to consume
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
-	record, err := s.CommitLog.Read(req.Offset)
+	if err := authorize(ctx, s.Authorizer, req.Topic, auth.Consume); err != nil {
+		return nil, err
+	}
+	clog, err := s.partition(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	record, err := clog.Read(req.Offset)
 	if err != nil {
 		return nil, err
 	}
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
+// OffsetForTime handles the requests made by clients to find where the log was at a given time,
+// so they can start consuming (with ConsumeStream, for example) from a wall-clock time.
+func (s *grpcServer) OffsetForTime(ctx context.Context, req *api.OffsetForTimeRequest) (*api.OffsetForTimeResponse, error) {
+	if err := authorize(ctx, s.Authorizer, req.Topic, auth.Consume); err != nil {
+		return nil, err
+	}
+	clog, err := s.partition(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := clog.OffsetForTime(time.Unix(0, req.Timestamp))
+	if err != nil {
+		return nil, err
+	}
+	return &api.OffsetForTimeResponse{Offset: offset}, nil
+}
+
 // ProduceStream implements a bidirectional streaming RPC so the client can stream data
 // into the server's log and the server can tell the client whether each request succeeded.
+// We receive in another goroutine so we can stop waiting for requests when the server shuts down,
+// but we always finish appending a request we've received. Each request names its own topic,
+// and Produce authorizes each one, which also picks up policy changes on long-lived streams.
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
+	type recv struct {
+		req *api.ProduceRequest
+		err error
+	}
+	reqs := make(chan recv)
+	// done lets the goroutine finish once we've returned, even with the client's requests
+	// still coming in and nobody left to take them.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			select {
+			case reqs <- recv{req, err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
 	for {
-		req, err := stream.Recv()
-		if err != nil {
-			return err
+		var r recv
+		select {
+		case r = <-reqs:
+		case <-s.Shutdown:
+			return errShuttingDown
+		}
+		if r.err == io.EOF {
+			// the client is done producing.
+			return nil
 		}
-		res, err := s.Produce(stream.Context(), req)
+		if r.err != nil {
+			return r.err
+		}
+		res, err := s.Produce(stream.Context(), r.req)
 		if err != nil {
 			return err
 		}
@@ -88,24 +305,104 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 // where in the log to read records, and then the server will stream every record that follows
 // (even records that aren't in the log yet!) When the server reaches the end of the log, the server
 // will wait until someone appends a record to the log and then continue streaming records to the client.
+// We read the log with an iterator, which reads it sequentially, and the log wakes us up when it appends,
+// so an idle stream doesn't cost anything. With a group, the stream starts at the group's committed offset.
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
-	for {
+	if err := authorize(stream.Context(), s.Authorizer, req.Topic, auth.Consume); err != nil {
+		return err
+	}
+	clog, err := s.partition(req.Topic, req.Partition)
+	if err != nil {
+		return err
+	}
+	offset, err := s.startOffset(req)
+	if err != nil {
+		return err
+	}
+	s.metrics.subscribers.Inc()
+	defer s.metrics.subscribers.Dec()
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	go func() {
 		select {
-		case <-stream.Context().Done():
-			return nil
-		default:
-			res, err := s.Consume(stream.Context(), req)
-			switch err.(type) {
-			case nil:
-			case api.ErrOffsetOutOfRange:
-				continue
-			default:
-				return err
+		case <-s.Shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	it := clog.NewIterator(offset)
+	defer it.Close()
+	for {
+		for it.Next() {
+			if s.shuttingDown() {
+				return errShuttingDown
 			}
-			if err = stream.Send(res); err != nil {
+			if err := stream.Send(&api.ConsumeResponse{Record: it.Record()}); err != nil {
 				return err
 			}
-			req.Offset++
 		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+		if err := clog.Wait(ctx, it.Offset()); err != nil {
+			if s.shuttingDown() {
+				return errShuttingDown
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// shuttingDown returns whether the server is shutting down.
+func (s *grpcServer) shuttingDown() bool {
+	select {
+	case <-s.Shutdown:
+		return true
+	default:
+		return false
 	}
-}
\ No newline at end of file
+}
+
+// The log's errors carry their own gRPC status (see api/v1/error.go), but anything else
+// a handler returns would reach the client as codes.Unknown. The error interceptors turn those
+// into statuses, so a client can always tell what went wrong from the code.
+
+func unaryErrorInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	res, err := handler(ctx, req)
+	return res, toStatus(err)
+}
+
+func streamErrorInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	return toStatus(handler(srv, ss))
+}
+
+// toStatus returns the error as a gRPC status error. Errors that don't have a status are
+// internal errors, except for context errors, which get their own codes.
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch err {
+	case context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
@@ -4,12 +4,16 @@ import (
 	"context"
 	"io/ioutil"
 	"net"
+	"runtime"
 	"testing"
+	"time"
 
 	api "github.com/hafizmfadli/proglog/api/v1"
 	"github.com/hafizmfadli/proglog/internal/log"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // TestServer defines our list of test cases and then runs a subtest for each case.
@@ -25,6 +29,26 @@ func TestServer(t *testing.T){
 			testProduceConsumeStream,
 		"consume past log boundary fails":
 			testConsumePastBoundary,
+		"offset for time succeeds":
+			testOffsetForTime,
+		"produce batch succeeds":
+			testProduceBatch,
+		"consume stream waits for new records":
+			testConsumeStreamWaits,
+		"produce too large a record fails":
+			testProduceTooLarge,
+		"produce without a record fails":
+			testProduceNoRecord,
+		"produce stream ends on a failed request":
+			testProduceStreamFails,
+		"only the default topic without a topic manager":
+			testTopicsWithoutManager,
+		"no offset RPCs without an offset store":
+			testOffsetsWithoutStore,
+		"no group RPCs without a coordinator":
+			testGroupsWithoutCoordinator,
+		"empty replication status without a replicator":
+			testReplicationWithoutReplicator,
 	}{
 		t.Run(scenario, func(t *testing.T) {
 			client, config, teardown := setupTest(t, nil)
@@ -41,6 +65,18 @@ func setupTest(t *testing.T, fn func(*Config)) (
 	teardown func(),
 ){
 	t.Helper()
+	cc, cfg, teardown := setupTestConn(t, fn)
+	return api.NewLogClient(cc), cfg, teardown
+}
+
+// setupTestConn sets up a server like setupTest, and returns the client's connection
+// so tests can call the server's other services.
+func setupTestConn(t *testing.T, fn func(*Config)) (
+	cc *grpc.ClientConn,
+	cfg *Config,
+	teardown func(),
+) {
+	t.Helper()
 
 	// creating listener on the local network address that our server will run on.
 	// The 0 port is useful for when we don't care what port we use since 0 will
@@ -51,7 +87,7 @@ func setupTest(t *testing.T, fn func(*Config)) (
 	// We then make an insecure connection to our listener and, with it, a client
 	// we'll use to hit our server with.
 	clientOptions := []grpc.DialOption{grpc.WithInsecure()}
-	cc, err := grpc.Dial(l.Addr().String(), clientOptions...)
+	cc, err = grpc.Dial(l.Addr().String(), clientOptions...)
 	require.NoError(t, err)
 
 	dir, err := ioutil.TempDir("", "server-test")
@@ -78,9 +114,7 @@ func setupTest(t *testing.T, fn func(*Config)) (
 		server.Serve(l)
 	}()
 
-	client = api.NewLogClient(cc)
-
-	return client, cfg, func() {
+	return cc, cfg, func() {
 		server.Stop()
 		cc.Close()
 		l.Close()
@@ -95,6 +129,10 @@ func testProduceConsume(t *testing.T, client api.LogClient, config *Config) {
 	ctx := context.Background()
 	want := &api.Record{
 		Value: []byte("hello world"),
+		Key:   []byte("user-1"),
+		Headers: []*api.Header{
+			{Key: "trace-id", Value: []byte("abc")},
+		},
 	}
 	produce, err := client.Produce(
 		ctx,
@@ -110,6 +148,9 @@ func testProduceConsume(t *testing.T, client api.LogClient, config *Config) {
 	require.NoError(t, err)
 	require.Equal(t, want.Value, consume.Record.Value)
 	require.Equal(t, want.Offset, consume.Record.Offset)
+	require.Equal(t, want.Key, consume.Record.Key)
+	require.Equal(t, "trace-id", consume.Record.Headers[0].Key)
+	require.Equal(t, []byte("abc"), consume.Record.Headers[0].Value)
 }
 
 // testConsumePastBoundary test that our sever responds with an api.ErrOffsetOutOfRange()
@@ -135,6 +176,7 @@ func testConsumePastBoundary(t *testing.T, client api.LogClient, config *Config)
 	if got != want {
 		t.Fatalf("got err: %v, want: %v", got, want)
 	}
+	require.Equal(t, codes.OutOfRange, got)
 }
 
 // testProduceConsumeStream is the streaming couterpart to testProduceConsume, testing
@@ -181,10 +223,174 @@ func testProduceConsumeStream(t *testing.T, client api.LogClient, config *Config
 		for i, record := range records {
 			res, err := stream.Recv()
 			require.NoError(t, err)
-			require.Equal(t, res.Record, &api.Record{
-				Value: record.Value,
-				Offset: uint64(i),
-			})
+			require.Equal(t, record.Value, res.Record.Value)
+			require.Equal(t, uint64(i), res.Record.Offset)
+			require.NotZero(t, res.Record.Timestamp)
 		}
 	}
-}
\ No newline at end of file
+}
+
+// testOffsetForTime tests that clients can find the offset of the first record
+// produced at or after a given time.
+func testOffsetForTime(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	produce := func() {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("hello world"),
+			},
+		})
+		require.NoError(t, err)
+	}
+	produce()
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	produce()
+
+	res, err := client.OffsetForTime(ctx, &api.OffsetForTimeRequest{
+		Timestamp: start.UnixNano(),
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Offset)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset: res.Offset,
+	})
+	require.NoError(t, err)
+	require.True(t, consume.Record.Timestamp >= start.UnixNano())
+}
+
+// testProduceBatch tests that a client can produce several records in one call
+// and consume each of them back from the offsets the server returns.
+func testProduceBatch(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	records := []*api.Record{
+		{Value: []byte("first message")},
+		{Value: []byte("second message")},
+		{Value: []byte("third message")},
+	}
+	produce, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: records,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2}, produce.Offsets)
+
+	for i, off := range produce.Offsets {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{
+			Offset: off,
+		})
+		require.NoError(t, err)
+		require.Equal(t, records[i].Value, consume.Record.Value)
+	}
+}
+
+// testConsumeStreamWaits tests that a stream that has caught up with the log
+// picks up the records appended after it started waiting.
+func testConsumeStreamWaits(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+
+	for i, value := range []string{"first message", "second message"} {
+		// give the stream time to catch up and wait.
+		time.Sleep(10 * time.Millisecond)
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value)},
+		})
+		require.NoError(t, err)
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, []byte(value), res.Record.Value)
+		require.Equal(t, uint64(i), res.Record.Offset)
+	}
+}
+
+// TestServerShutdown tests that streams end with codes.Unavailable once the
+// server shuts down, instead of keeping the server from stopping.
+func TestServerShutdown(t *testing.T) {
+	shutdown := make(chan struct{})
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.Shutdown = shutdown
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	consume, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	produce, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, produce.Send(&api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	}))
+	res, err := produce.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+	rec, err := consume.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), rec.Record.Value)
+
+	close(shutdown)
+	_, err = consume.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = produce.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+// testProduceTooLarge tests that the log's typed errors reach the client with their codes.
+func testProduceTooLarge(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: make([]byte, 2<<20)},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// testProduceNoRecord tests that the server refuses produce requests that are missing
+// a record, or have a nil one in the batch, rather than handing the log a nil record.
+func testProduceNoRecord(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	// a nil record in a batch goes over the wire as an empty one, so only callers in
+	// the same process can send one. We call the server directly, like they would.
+	srv, err := newgrpcServer(config)
+	require.NoError(t, err)
+	_, err = srv.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: []*api.Record{{Value: []byte("hello world")}, nil},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	off, err := config.CommitLog.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+}
+
+// testProduceStreamFails tests that a produce stream ends with the error of the first
+// request that fails, and that the server stops receiving the requests the client
+// pipelined after it, rather than leaving a goroutine waiting to hand them over.
+func testProduceStreamFails(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	// the first call connects the client, which starts the connection's goroutines.
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	goroutines := runtime.NumGoroutine()
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{
+		Record: &api.Record{Value: make([]byte, 2<<20)},
+	}))
+	for i := 0; i < 5; i++ {
+		require.NoError(t, stream.Send(&api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		}))
+	}
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	// we poll by hand, since require.Eventually checks in a goroutine of its own.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.LessOrEqual(t, runtime.NumGoroutine(), goroutines)
+}
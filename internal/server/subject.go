@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// With mutual TLS, the TLS handshake has already verified the client's certificate by the
+// time a request reaches us, so all that's left is to find out who the client is. We take the
+// subject's common name from the client's verified certificate and put it in the request's context,
+// where handlers (and the authorizer) get it with Subject.
+
+type subjectContextKey struct{}
+
+// Subject returns the authenticated client's subject, or "" if the client didn't
+// authenticate with a certificate.
+func Subject(ctx context.Context) string {
+	subject, _ := ctx.Value(subjectContextKey{}).(string)
+	return subject
+}
+
+// withSubject returns a context with the subject of the client the connection state verified.
+func withSubject(ctx context.Context, state tls.ConnectionState) context.Context {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ctx
+	}
+	subject := state.VerifiedChains[0][0].Subject.CommonName
+	return context.WithValue(ctx, subjectContextKey{}, subject)
+}
+
+// authenticate puts the subject of the gRPC client's certificate in the context.
+func authenticate(ctx context.Context) context.Context {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ctx
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return ctx
+	}
+	return withSubject(ctx, tlsInfo.State)
+}
+
+func unaryAuthenticateInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	return handler(authenticate(ctx), req)
+}
+
+func streamAuthenticateInterceptor(
+	srv interface{},
+	ss grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	return handler(srv, &contextStream{ss, authenticate(ss.Context())})
+}
+
+// contextStream is a server stream with another context, like one with the client's subject.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// authenticateHTTP is the HTTP middleware that puts the subject of the client's
+// certificate in the request's context.
+func authenticateHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			r = r.WithContext(withSubject(r.Context(), *r.TLS))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
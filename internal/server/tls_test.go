@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/hafizmfadli/proglog/internal/auth"
+	"github.com/hafizmfadli/proglog/internal/config"
+	"github.com/hafizmfadli/proglog/internal/log"
+	"github.com/hafizmfadli/proglog/internal/testca"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// testCerts holds a throwaway CA, and the server's TLS config.
+type testCerts struct {
+	dir    string
+	ca     *testca.CA
+	server *tls.Config
+}
+
+func newTestCerts(t *testing.T) *testCerts {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tls-test")
+	require.NoError(t, err)
+	ca, err := testca.New(dir)
+	require.NoError(t, err)
+	certFile, keyFile, err := ca.Issue("server", true)
+	require.NoError(t, err)
+	server, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		CAFile:   ca.CertFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	return &testCerts{dir: dir, ca: ca, server: server}
+}
+
+// client returns the TLS config for a client with a certificate for the given
+// subject, or without a certificate if the subject is empty.
+func (c *testCerts) client(t *testing.T, subject string) *tls.Config {
+	t.Helper()
+	cfg := config.TLSConfig{CAFile: c.ca.CertFile, ServerAddress: "127.0.0.1"}
+	if subject != "" {
+		var err error
+		cfg.CertFile, cfg.KeyFile, err = c.ca.Issue(subject, false)
+		require.NoError(t, err)
+	}
+	tc, err := config.SetupTLSConfig(cfg)
+	require.NoError(t, err)
+	return tc
+}
+
+func TestServerMutualTLS(t *testing.T) {
+	certs := newTestCerts(t)
+	defer os.RemoveAll(certs.dir)
+	dir, err := ioutil.TempDir("", "server-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+
+	// an interceptor after ours sees the subject, like the handlers do.
+	subjects := make(chan string, 1)
+	gsrv, err := NewGRPCServer(
+		&Config{CommitLog: clog, TLSConfig: certs.server},
+		grpc.ChainUnaryInterceptor(func(
+			ctx context.Context,
+			req interface{},
+			info *grpc.UnaryServerInfo,
+			handler grpc.UnaryHandler,
+		) (interface{}, error) {
+			subjects <- Subject(ctx)
+			return handler(ctx, req)
+		}),
+	)
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go gsrv.Serve(l)
+	defer gsrv.Stop()
+
+	dial := func(tc *tls.Config) api.LogClient {
+		cc, err := grpc.Dial(
+			l.Addr().String(),
+			grpc.WithTransportCredentials(credentials.NewTLS(tc)),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { cc.Close() })
+		return api.NewLogClient(cc)
+	}
+	ctx := context.Background()
+	produce := &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}}
+
+	client := dial(certs.client(t, "root"))
+	res, err := client.Produce(ctx, produce)
+	require.NoError(t, err)
+	require.Equal(t, "root", <-subjects)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: res.Offset})
+	require.NoError(t, err)
+	require.Equal(t, "root", <-subjects)
+
+	// a client without a certificate, or with one from another CA, can't connect.
+	_, err = dial(certs.client(t, "")).Produce(ctx, produce)
+	require.Error(t, err)
+	other := newTestCerts(t)
+	defer os.RemoveAll(other.dir)
+	tc := other.client(t, "root")
+	tc.RootCAs = certs.client(t, "").RootCAs
+	_, err = dial(tc).Produce(ctx, produce)
+	require.Error(t, err)
+}
+
+func TestHTTPMutualTLS(t *testing.T) {
+	certs := newTestCerts(t)
+	defer os.RemoveAll(certs.dir)
+	srv := httptest.NewUnstartedServer(authenticateHTTP(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(Subject(r.Context())))
+		},
+	)))
+	srv.TLS = certs.server
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(tc *tls.Config) (string, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		return string(b), err
+	}
+	subject, err := get(certs.client(t, "root"))
+	require.NoError(t, err)
+	require.Equal(t, "root", subject)
+	_, err = get(certs.client(t, ""))
+	require.Error(t, err)
+}
+
+// TestServerAuthorization tests that the server enforces the authorizer's policy
+// for the subject of each client's certificate, on both front-ends.
+func TestServerAuthorization(t *testing.T) {
+	certs := newTestCerts(t)
+	defer os.RemoveAll(certs.dir)
+	dir, err := ioutil.TempDir("", "server-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	policy := filepath.Join(certs.dir, "policy.yaml")
+	require.NoError(t, ioutil.WriteFile(policy, []byte(`
+rules:
+  - subject: root
+    actions: [produce, consume]
+  - subject: reader
+    actions: [consume]
+`), 0644))
+	authorizer, err := auth.New(policy)
+	require.NoError(t, err)
+	cfg := &Config{
+		CommitLog:  clog,
+		TLSConfig:  certs.server,
+		Authorizer: authorizer,
+	}
+
+	gsrv, err := NewGRPCServer(cfg)
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go gsrv.Serve(l)
+	defer gsrv.Stop()
+	dial := func(subject string) api.LogClient {
+		cc, err := grpc.Dial(
+			l.Addr().String(),
+			grpc.WithTransportCredentials(credentials.NewTLS(certs.client(t, subject))),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { cc.Close() })
+		return api.NewLogClient(cc)
+	}
+	ctx := context.Background()
+	produce := &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}}
+	consume := &api.ConsumeRequest{Offset: 0}
+
+	_, err = dial("root").Produce(ctx, produce)
+	require.NoError(t, err)
+	reader := dial("reader")
+	_, err = reader.Consume(ctx, consume)
+	require.NoError(t, err)
+	_, err = reader.Produce(ctx, produce)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	// each request on a produce stream names its topic, so the stream fails on the first one.
+	stream, err := reader.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(produce))
+	_, err = stream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	nobody := dial("nobody")
+	_, err = nobody.Consume(ctx, consume)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	cstream, err := nobody.ConsumeStream(ctx, consume)
+	require.NoError(t, err)
+	_, err = cstream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// the HTTP server enforces the same policy.
+	srv := httptest.NewUnstartedServer(NewHTTPServer("", cfg).Handler)
+	srv.TLS = certs.server
+	srv.StartTLS()
+	defer srv.Close()
+	post := func(subject string) int {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: certs.client(t, subject),
+		}}
+		resp, err := client.Post(
+			srv.URL,
+			"application/json",
+			strings.NewReader(`{"record":{"value":"aGk="}}`),
+		)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusOK, post("root"))
+	require.Equal(t, http.StatusForbidden, post("reader"))
+
+	// the authorizer picks up policy changes without a restart.
+	require.NoError(t, ioutil.WriteFile(policy, []byte(`
+rules:
+  - subject: "*"
+    actions: [produce]
+`), 0644))
+	require.NoError(t, authorizer.Reload())
+	_, err = reader.Produce(ctx, produce)
+	require.NoError(t, err)
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/hafizmfadli/proglog/internal/auth"
+	"github.com/hafizmfadli/proglog/internal/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Every request names its topic, and the servers serve it from that topic's partitions,
+// each with its own log. With a TopicManager, the servers serve every topic it has (and the
+// admin RPCs create and delete topics); without one, they only serve the default topic, with
+// a single partition, from the config's CommitLog.
+
+// TopicManager gives the servers the logs of each topic's partitions. NewTopicManager makes
+// one out of a log.LogManager.
+type TopicManager interface {
+	// Partitions returns the logs of the topic's partitions, in order, or api.ErrTopicNotFound.
+	Partitions(topic string) ([]CommitLog, error)
+	// Route returns the partition, and its log, to append a record with the given key to.
+	Route(topic string, key []byte) (uint32, CommitLog, error)
+	CreateTopic(topic string, c log.TopicConfig) error
+	DeleteTopic(topic string) error
+	Topics() []log.Topic
+}
+
+// NewTopicManager returns a TopicManager that serves the log manager's topics.
+func NewTopicManager(m *log.LogManager) TopicManager {
+	return logManager{m}
+}
+
+type logManager struct {
+	*log.LogManager
+}
+
+func (m logManager) Partitions(topic string) ([]CommitLog, error) {
+	partitions, err := m.LogManager.Partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+	logs := make([]CommitLog, len(partitions))
+	for i, l := range partitions {
+		logs[i] = l
+	}
+	return logs, nil
+}
+
+func (m logManager) Route(topic string, key []byte) (uint32, CommitLog, error) {
+	p, l, err := m.LogManager.Route(topic, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	return p, l, nil
+}
+
+// errNoTopics is what the admin RPCs return when the server serves a single log.
+var errNoTopics = status.Error(codes.Unimplemented, "the server doesn't manage topics")
+
+// topicOrDefault returns the topic, or the default topic if it's empty.
+func topicOrDefault(topic string) string {
+	if topic == "" {
+		return log.DefaultTopic
+	}
+	return topic
+}
+
+// partitions returns the logs of the topic's partitions.
+func (c *Config) partitions(topic string) ([]CommitLog, error) {
+	topic = topicOrDefault(topic)
+	if c.Topics != nil {
+		return c.Topics.Partitions(topic)
+	}
+	if topic != log.DefaultTopic {
+		return nil, api.ErrTopicNotFound{Topic: topic}
+	}
+	return []CommitLog{c.CommitLog}, nil
+}
+
+// partition returns the log of the topic's partition, or api.ErrPartitionNotFound.
+func (c *Config) partition(topic string, partition uint32) (CommitLog, error) {
+	partitions, err := c.partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+	if partition >= uint32(len(partitions)) {
+		return nil, api.ErrPartitionNotFound{Topic: topicOrDefault(topic), Partition: partition}
+	}
+	return partitions[partition], nil
+}
+
+// route returns the partition of the topic, and its log, to append a record with the given key to.
+func (c *Config) route(topic string, key []byte) (uint32, CommitLog, error) {
+	topic = topicOrDefault(topic)
+	if c.Topics != nil {
+		return c.Topics.Route(topic, key)
+	}
+	l, err := c.partition(topic, 0)
+	return 0, l, err
+}
+
+// errBatchPartitions is what produce batch requests get when their keys pick different partitions.
+var errBatchPartitions = status.Error(
+	codes.InvalidArgument,
+	"the batch's keys pick different partitions, produce them in separate batches",
+)
+
+// routeBatch returns the partition of the topic, and its log, to append the batch to. A batch
+// is all or nothing, so it goes to a single partition: the one its records' keys pick. Keys
+// that pick different partitions would break the promise that a key's records all end up in
+// its partition, in order, so routeBatch returns errBatchPartitions for them. Records without
+// a key go wherever the batch goes.
+func (c *Config) routeBatch(topic string, records []*api.Record) (uint32, CommitLog, error) {
+	var key []byte
+	for _, record := range records {
+		if len(record.GetKey()) > 0 {
+			key = record.Key
+			break
+		}
+	}
+	partition, l, err := c.route(topic, key)
+	if err != nil {
+		return 0, nil, err
+	}
+	seen := map[string]bool{string(key): true}
+	for _, record := range records {
+		if len(record.GetKey()) == 0 || seen[string(record.Key)] {
+			continue
+		}
+		seen[string(record.Key)] = true
+		p, _, err := c.route(topic, record.Key)
+		if err != nil {
+			return 0, nil, err
+		}
+		if p != partition {
+			return 0, nil, errBatchPartitions
+		}
+	}
+	return partition, l, nil
+}
+
+// CreateTopic handles the requests made by admins to create a topic with its own config.
+func (s *grpcServer) CreateTopic(ctx context.Context, req *api.CreateTopicRequest) (*api.CreateTopicResponse, error) {
+	if err := authorize(ctx, s.Authorizer, req.Topic, auth.Admin); err != nil {
+		return nil, err
+	}
+	if s.Topics == nil {
+		return nil, errNoTopics
+	}
+	if err := s.Topics.CreateTopic(req.Topic, log.TopicConfigFromProto(req.Config)); err != nil {
+		return nil, err
+	}
+	return &api.CreateTopicResponse{}, nil
+}
+
+// DeleteTopic handles the requests made by admins to delete a topic and its records.
+func (s *grpcServer) DeleteTopic(ctx context.Context, req *api.DeleteTopicRequest) (*api.DeleteTopicResponse, error) {
+	if err := authorize(ctx, s.Authorizer, req.Topic, auth.Admin); err != nil {
+		return nil, err
+	}
+	if s.Topics == nil {
+		return nil, errNoTopics
+	}
+	if err := s.Topics.DeleteTopic(topicOrDefault(req.Topic)); err != nil {
+		return nil, err
+	}
+	return &api.DeleteTopicResponse{}, nil
+}
+
+// ListTopics handles the requests made by admins to list the topics, along with their
+// config. Clients only see the topics they may administer.
+func (s *grpcServer) ListTopics(ctx context.Context, req *api.ListTopicsRequest) (*api.ListTopicsResponse, error) {
+	if s.Topics == nil {
+		return nil, errNoTopics
+	}
+	res := &api.ListTopicsResponse{}
+	for _, t := range s.Topics.Topics() {
+		if authorize(ctx, s.Authorizer, t.Name, auth.Admin) != nil {
+			continue
+		}
+		res.Topics = append(res.Topics, &api.Topic{
+			Name:   t.Name,
+			Config: t.Config.Proto(),
+		})
+	}
+	return res, nil
+}
+
+// Metadata handles the requests made by clients to find a topic's partitions and the
+// offsets each has, so they know which partitions to consume and from where. Without
+// topics in the request, clients get every topic they may consume.
+func (s *grpcServer) Metadata(ctx context.Context, req *api.MetadataRequest) (*api.MetadataResponse, error) {
+	topics := req.Topics
+	all := len(topics) == 0
+	if all {
+		if s.Topics == nil {
+			topics = []string{log.DefaultTopic}
+		}
+		for _, t := range s.topics() {
+			topics = append(topics, t.Name)
+		}
+	}
+	res := &api.MetadataResponse{}
+	for _, topic := range topics {
+		if err := authorize(ctx, s.Authorizer, topic, auth.Consume); err != nil {
+			if all {
+				continue
+			}
+			return nil, err
+		}
+		partitions, err := s.partitions(topic)
+		if err != nil {
+			return nil, err
+		}
+		md := &api.TopicMetadata{Name: topicOrDefault(topic)}
+		for i, l := range partitions {
+			lowest, err := l.LowestOffset()
+			if err != nil {
+				return nil, err
+			}
+			next, err := l.NextOffset()
+			if err != nil {
+				return nil, err
+			}
+			md.Partitions = append(md.Partitions, &api.PartitionMetadata{
+				Id:           uint32(i),
+				LowestOffset: lowest,
+				NextOffset:   next,
+			})
+		}
+		res.Topics = append(res.Topics, md)
+	}
+	return res, nil
+}
+
+// topics returns the manager's topics, if the server has one.
+func (c *Config) topics() []log.Topic {
+	if c.Topics == nil {
+		return nil
+	}
+	return c.Topics.Topics()
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/hafizmfadli/proglog/api/v1"
+	"github.com/hafizmfadli/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestTopics tests that requests go to their topic's log, and that admins can manage topics.
+func TestTopics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	m, err := log.NewLogManager(dir, log.ManagerConfig{})
+	require.NoError(t, err)
+	defer m.Close()
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.Topics = NewTopicManager(m)
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+		Topic:  "orders",
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic:  "orders",
+		Config: &api.TopicConfig{MaxStoreBytes: 1024, RetentionMs: 60000},
+	})
+	require.NoError(t, err)
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: "orders"})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: "a/b"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	list, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.Topics, 2)
+	require.Equal(t, log.DefaultTopic, list.Topics[0].Name)
+	require.Equal(t, "orders", list.Topics[1].Name)
+	require.Equal(t, uint64(1024), list.Topics[1].Config.MaxStoreBytes)
+	require.Equal(t, int64(60000), list.Topics[1].Config.RetentionMs)
+
+	// each topic has its own offsets.
+	for _, topic := range []string{"orders", "orders", ""} {
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello " + topic)},
+			Topic:  topic,
+		})
+		require.NoError(t, err)
+	}
+	batch, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: []*api.Record{{Value: []byte("hello orders")}},
+		Topic:   "orders",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2}, batch.Offsets)
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 1, Topic: "orders"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello orders"), consume.Record.Value)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1, Topic: log.DefaultTopic})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello "), res.Record.Value)
+
+	_, err = client.DeleteTopic(ctx, &api.DeleteTopicRequest{Topic: "orders"})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0, Topic: "orders"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+// TestPartitions tests that produce requests go to the partition their key picks, that
+// consume requests read the partition they name, and that the metadata RPC lists each
+// partition's offsets.
+func TestPartitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partitions-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	m, err := log.NewLogManager(dir, log.ManagerConfig{})
+	require.NoError(t, err)
+	defer m.Close()
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.Topics = NewTopicManager(m)
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic:  "orders",
+		Config: &api.TopicConfig{Partitions: 3},
+	})
+	require.NoError(t, err)
+	list, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), list.Topics[1].Config.Partitions)
+
+	// records with the same key go to the same partition, in order.
+	var partition uint32
+	for i := uint64(0); i < 3; i++ {
+		res, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Key: []byte("customer-1"), Value: []byte("hello world")},
+			Topic:  "orders",
+		})
+		require.NoError(t, err)
+		require.Equal(t, i, res.Offset)
+		if i > 0 {
+			require.Equal(t, partition, res.Partition)
+		}
+		partition = res.Partition
+	}
+	batch, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: []*api.Record{
+			{Key: []byte("customer-1"), Value: []byte("hello batch")},
+			{Value: []byte("hello batch")},
+		},
+		Topic: "orders",
+	})
+	require.NoError(t, err)
+	require.Equal(t, partition, batch.Partition)
+	require.Equal(t, []uint64{3, 4}, batch.Offsets)
+	// a batch can't hold keys from different partitions, so the batch fails as a whole.
+	other := []byte("customer-2")
+	for i := 3; (&log.Partitioner{}).Partition(other, 3) == partition; i++ {
+		other = []byte(fmt.Sprintf("customer-%d", i))
+	}
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: []*api.Record{
+			{Key: []byte("customer-1"), Value: []byte("hello batch")},
+			{Key: other, Value: []byte("hello batch")},
+		},
+		Topic: "orders",
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset:    3,
+		Topic:     "orders",
+		Partition: partition,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello batch"), consume.Record.Value)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0, Topic: "orders", Partition: 3})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	md, err := client.Metadata(ctx, &api.MetadataRequest{Topics: []string{"orders"}})
+	require.NoError(t, err)
+	require.Len(t, md.Topics, 1)
+	require.Equal(t, "orders", md.Topics[0].Name)
+	require.Len(t, md.Topics[0].Partitions, 3)
+	for i, p := range md.Topics[0].Partitions {
+		require.Equal(t, uint32(i), p.Id)
+		require.Equal(t, uint64(0), p.LowestOffset)
+		next := uint64(0)
+		if p.Id == partition {
+			next = 5
+		}
+		require.Equal(t, next, p.NextOffset)
+	}
+	md, err = client.Metadata(ctx, &api.MetadataRequest{})
+	require.NoError(t, err)
+	require.Len(t, md.Topics, 2)
+	require.Equal(t, log.DefaultTopic, md.Topics[0].Name)
+	require.Len(t, md.Topics[0].Partitions, 1)
+	_, err = client.Metadata(ctx, &api.MetadataRequest{Topics: []string{"payments"}})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+// testTopicsWithoutManager tests that a server with a single log only serves the default topic.
+func testTopicsWithoutManager(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	for _, topic := range []string{"", log.DefaultTopic} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+			Topic:  topic,
+		})
+		require.NoError(t, err)
+	}
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+		Topic:  "orders",
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: "orders"})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	md, err := client.Metadata(ctx, &api.MetadataRequest{})
+	require.NoError(t, err)
+	require.Len(t, md.Topics, 1)
+	require.Equal(t, log.DefaultTopic, md.Topics[0].Name)
+	require.Equal(t, uint64(2), md.Topics[0].Partitions[0].NextOffset)
+}